@@ -0,0 +1,106 @@
+package git
+
+// This file implements abbreviated object ids.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// An AmbiguousIdError is returned when an abbreviated object id matches
+// more than one object. It wraps ErrAmbiguousId.
+type AmbiguousIdError struct {
+	Prefix     string
+	Candidates []Id // the objects it matches, in order
+}
+
+func (e *AmbiguousIdError) Error() string {
+	ids := make([]string, len(e.Candidates))
+	for i, id := range e.Candidates {
+		ids[i] = id.String()
+	}
+	return fmt.Sprintf("%v %s could be %s", ErrAmbiguousId, e.Prefix, strings.Join(ids, ", "))
+}
+
+func (e *AmbiguousIdError) Unwrap() error {
+	return ErrAmbiguousId
+}
+
+// minAbbrev is the shortest abbreviation git accepts.
+const minAbbrev = 4
+
+// ResolvePrefix returns the id of the only object whose id starts with
+// prefix, which is from 4 to 40 hex digits. It returns an
+// *AmbiguousIdError if several objects match, and an error wrapping
+// ErrObjectNotFound if none does.
+func (r *Repo) ResolvePrefix(prefix string) (Id, error) {
+	prefix = strings.ToLower(prefix)
+	if len(prefix) < minAbbrev || len(prefix) > 40 || strings.Trim(prefix, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("git: bad object id prefix %q", prefix)
+	}
+	ids, err := r.matchPrefix(prefix)
+	if err != nil {
+		return "", err
+	}
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("%w: %s", ErrObjectNotFound, prefix)
+	case 1:
+		return ids[0], nil
+	}
+	return "", &AmbiguousIdError{prefix, ids}
+}
+
+// Abbrev returns the shortest prefix of id's hex form, but no shorter than
+// minLen digits, that no other object in the repository's id starts with.
+// Git abbreviates ids to 7 digits unless that's ambiguous. id doesn't have
+// to be in the repository.
+func (r *Repo) Abbrev(id Id, minLen int) (string, error) {
+	if len(id) != 20 {
+		return "", fmt.Errorf("git: bad object id %q", id.String())
+	}
+	if minLen < minAbbrev {
+		minLen = minAbbrev
+	} else if minLen > 40 {
+		minLen = 40
+	}
+	full := id.String()
+	ids, err := r.matchPrefix(full[:minLen])
+	if err != nil {
+		return "", err
+	}
+	n := minLen
+	for _, other := range ids {
+		if other == id {
+			continue
+		}
+		// one more digit than they have in common tells them apart
+		s := other.String()
+		common := 0
+		for common < 40 && s[common] == full[common] {
+			common++
+		}
+		if common+1 > n {
+			n = common + 1
+		}
+	}
+	return full[:n], nil
+}
+
+// matchPrefix returns the ids of r's objects whose hex forms start with
+// prefix, in order.
+func (r *Repo) matchPrefix(prefix string) ([]Id, error) {
+	if s, ok := r.objects.(*FileStore); ok {
+		return s.matchPrefix(prefix)
+	}
+	var ids []Id
+	err := r.ForEachObject(func(id Id, _ ObjectType) error {
+		if strings.HasPrefix(id.String(), prefix) {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, err
+}
@@ -0,0 +1,156 @@
+package git
+
+// This file implements the caches that make reading the same objects over
+// and over cheaper.
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CacheStats describes a cache's contents and how well it's doing.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Size      int64 // total size of the entries, in the units of Limit
+	Limit     int64
+}
+
+// An lru is a cache that evicts the least recently used entries to keep
+// their total cost under a limit. It's safe for concurrent use.
+type lru struct {
+	mu      sync.Mutex
+	limit   int64
+	entries map[interface{}]*list.Element
+	order   list.List // of *lruEntry, most recently used first
+	stats   CacheStats
+}
+
+type lruEntry struct {
+	key   interface{}
+	value interface{}
+	cost  int64
+}
+
+func newLRU(limit int64) *lru {
+	return &lru{limit: limit, entries: map[interface{}]*list.Element{}}
+}
+
+func (c *lru) get(key interface{}) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).value, true
+}
+
+// add adds value to the cache, unless it costs more than the whole cache
+// can hold.
+func (c *lru) add(key, value interface{}, cost int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cost > c.limit {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		e := elem.Value.(*lruEntry)
+		c.stats.Size += cost - e.cost
+		e.value, e.cost = value, cost
+		c.order.MoveToFront(elem)
+	} else {
+		c.entries[key] = c.order.PushFront(&lruEntry{key, value, cost})
+		c.stats.Size += cost
+	}
+	c.evict()
+}
+
+func (c *lru) setLimit(limit int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limit = limit
+	c.evict()
+}
+
+// evict removes entries until they fit in the limit. c.mu must be held.
+func (c *lru) evict() {
+	for c.stats.Size > c.limit {
+		elem := c.order.Back()
+		e := elem.Value.(*lruEntry)
+		c.order.Remove(elem)
+		delete(c.entries, e.key)
+		c.stats.Size -= e.cost
+		c.stats.Evictions++
+	}
+}
+
+func (c *lru) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Limit = c.limit
+	return stats
+}
+
+// defaultDeltaCacheSize is the default number of bytes of delta bases a
+// FileStore keeps. It's the same as git's core.deltaBaseCacheLimit.
+const defaultDeltaCacheSize = 96 << 20
+
+// A deltaBaseKey identifies a delta base by where it is.
+type deltaBaseKey struct {
+	p      *pack
+	offset uint64
+}
+
+type deltaBase struct {
+	objType int
+	data    []byte
+}
+
+// SetDeltaCacheSize sets how many bytes of delta bases s keeps in memory,
+// shared with its alternates. Deltas often share bases, so keeping them
+// saves reading and reapplying whole delta chains. Zero turns the cache
+// off.
+func (s *FileStore) SetDeltaCacheSize(size int64) {
+	s.bases.setLimit(size)
+}
+
+// DeltaCacheStats returns statistics about s's cache of delta bases.
+func (s *FileStore) DeltaCacheStats() CacheStats {
+	return s.bases.Stats()
+}
+
+// SetObjectCacheSize sets how many parsed objects GetObject keeps in
+// memory. The cache is off, with a size of zero, unless this is called.
+// While it's on, callers of GetObject may share objects, so they mustn't
+// modify them.
+func (r *Repo) SetObjectCacheSize(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n <= 0 {
+		r.cache = nil
+	} else if r.cache == nil {
+		r.cache = newLRU(int64(n))
+	} else {
+		r.cache.setLimit(int64(n))
+	}
+}
+
+// ObjectCacheStats returns statistics about r's cache of parsed objects.
+// Its size is in objects.
+func (r *Repo) ObjectCacheStats() CacheStats {
+	r.mu.Lock()
+	cache := r.cache
+	r.mu.Unlock()
+	if cache == nil {
+		return CacheStats{}
+	}
+	return cache.Stats()
+}
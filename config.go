@@ -0,0 +1,188 @@
+package git
+
+// This file implements reading git's config files.
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// A config holds the settings from a config file. Keys are
+// "section.name" or "section.subsection.name", with the section and name
+// lowercased. Every value of a key that's set more than once is kept, in
+// order.
+type config map[string][]string
+
+// readConfig reads the config file name in fsys. A missing file is an empty
+// config.
+func readConfig(fsys FileSystem, name string) (config, error) {
+	content, err := fs.ReadFile(fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return config{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	c, err := parseConfig(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("git: %s: %v", name, err)
+	}
+	return c, nil
+}
+
+func parseConfig(s string) (config, error) {
+	c := config{}
+	section := ""
+	for lineno := 1; s != ""; lineno++ {
+		var line string
+		if nl := strings.IndexByte(s, '\n'); nl >= 0 {
+			line, s = s[:nl], s[nl+1:]
+		} else {
+			line, s = s, ""
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.LastIndexByte(line, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: bad section header", lineno)
+			}
+			var err error
+			if section, err = parseSection(line[1:end]); err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+			continue
+		}
+		if section == "" {
+			return nil, fmt.Errorf("line %d: setting outside a section", lineno)
+		}
+		name, value := line, ""
+		hasValue := false
+		if eq := strings.IndexByte(line, '='); eq >= 0 {
+			name, value, hasValue = strings.TrimSpace(line[:eq]), line[eq+1:], true
+		}
+		if name == "" {
+			return nil, fmt.Errorf("line %d: missing name", lineno)
+		}
+		if !hasValue {
+			// a name on its own means true
+			value = "true"
+		} else {
+			// a backslash at the end of a line continues the value
+			for strings.HasSuffix(value, "\\") && !strings.HasSuffix(value, "\\\\") && s != "" {
+				var next string
+				if nl := strings.IndexByte(s, '\n'); nl >= 0 {
+					next, s = s[:nl], s[nl+1:]
+				} else {
+					next, s = s, ""
+				}
+				value = value[:len(value)-1] + next
+				lineno++
+			}
+			var err error
+			if value, err = parseConfigValue(value); err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+		}
+		key := section + "." + strings.ToLower(name)
+		c[key] = append(c[key], value)
+	}
+	return c, nil
+}
+
+// parseSection parses what's between the brackets of a section header.
+func parseSection(header string) (string, error) {
+	quote := strings.IndexByte(header, '"')
+	if quote < 0 {
+		// the old [section.subsection] syntax lowercases everything
+		return strings.ToLower(strings.TrimSpace(header)), nil
+	}
+	name := strings.ToLower(strings.TrimSpace(header[:quote]))
+	sub := header[quote+1:]
+	if !strings.HasSuffix(sub, "\"") || name == "" {
+		return "", errors.New("bad section header")
+	}
+	sub = sub[:len(sub)-1]
+	var b strings.Builder
+	for i := 0; i < len(sub); i++ {
+		if sub[i] == '\\' && i+1 < len(sub) {
+			i++
+		}
+		b.WriteByte(sub[i])
+	}
+	return name + "." + b.String(), nil
+}
+
+// parseConfigValue handles the quoting, escapes and comments in a value.
+func parseConfigValue(v string) (string, error) {
+	var b strings.Builder
+	quoted := false
+	spaces := "" // unquoted whitespace that's only kept if more follows
+	v = strings.TrimLeft(v, " \t")
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+			continue
+		case (c == '#' || c == ';') && !quoted:
+			i = len(v)
+			continue
+		case (c == ' ' || c == '\t') && !quoted:
+			spaces += string(c)
+			continue
+		case c == '\\':
+			if i+1 >= len(v) {
+				return "", errors.New("bad escape")
+			}
+			i++
+			switch v[i] {
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case '"', '\\':
+				c = v[i]
+			default:
+				return "", errors.New("bad escape")
+			}
+		}
+		b.WriteString(spaces)
+		spaces = ""
+		b.WriteByte(c)
+	}
+	if quoted {
+		return "", errors.New("unterminated quote")
+	}
+	return b.String(), nil
+}
+
+// get returns the last value of key.
+func (c config) get(key string) (string, bool) {
+	values := c[key]
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[len(values)-1], true
+}
+
+// bool returns the value of a boolean setting. ok is false if key isn't
+// set or isn't a boolean.
+func (c config) bool(key string) (value, ok bool) {
+	v, ok := c.get(key)
+	if !ok {
+		return false, false
+	}
+	switch strings.ToLower(v) {
+	case "true", "yes", "on", "1":
+		return true, true
+	case "false", "no", "off", "0", "":
+		return false, true
+	}
+	return false, false
+}
@@ -0,0 +1,129 @@
+package git
+
+// This file implements creating deltas in the format applyDelta reads.
+
+import (
+	"bytes"
+)
+
+const (
+	// deltaBlock is the size of the chunks of the base that are indexed
+	// when looking for matches.
+	deltaBlock = 16
+	// maxBucket bounds how many base offsets are remembered per hash, so
+	// highly repetitive bases don't make matching quadratic.
+	maxBucket = 64
+	// maxCopy is the largest copy a single instruction does. The format
+	// allows more, but older versions of git only accept this much.
+	maxCopy = 0x10000
+	// maxInsert is the most bytes a single insert instruction can carry.
+	maxInsert = 0x7F
+)
+
+// blockHash is FNV-1a over a deltaBlock-sized window.
+func blockHash(b []byte) uint32 {
+	h := uint32(2166136261)
+	for _, c := range b[:deltaBlock] {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return h
+}
+
+// createDelta returns a delta that turns base into target. If the delta
+// would be larger than maxSize bytes, it gives up and returns nil.
+func createDelta(base, target []byte, maxSize int) []byte {
+	index := make(map[uint32][]int, len(base)/deltaBlock)
+	for i := 0; i+deltaBlock <= len(base); i += deltaBlock {
+		h := blockHash(base[i:])
+		if len(index[h]) < maxBucket {
+			index[h] = append(index[h], i)
+		}
+	}
+
+	d := bytes.NewBuffer(nil)
+	d.Write(encodeVarint(uint64(len(base))))
+	d.Write(encodeVarint(uint64(len(target))))
+	insertStart := 0
+	for i := 0; i+deltaBlock <= len(target); {
+		bestOffset, bestLen := 0, 0
+		for _, offset := range index[blockHash(target[i:])] {
+			n := matchLen(base[offset:], target[i:])
+			if n > bestLen {
+				bestOffset, bestLen = offset, n
+			}
+		}
+		if bestLen < deltaBlock {
+			i++
+			continue
+		}
+		// the match might start before the block we found it with
+		for bestOffset > 0 && i > insertStart && base[bestOffset-1] == target[i-1] {
+			bestOffset--
+			i--
+			bestLen++
+		}
+		writeInserts(d, target[insertStart:i])
+		writeCopies(d, bestOffset, bestLen)
+		i += bestLen
+		insertStart = i
+		if maxSize > 0 && d.Len() > maxSize {
+			return nil
+		}
+	}
+	writeInserts(d, target[insertStart:])
+	if maxSize > 0 && d.Len() > maxSize {
+		return nil
+	}
+	return d.Bytes()
+}
+
+func matchLen(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+func writeInserts(d *bytes.Buffer, data []byte) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxInsert {
+			n = maxInsert
+		}
+		d.WriteByte(byte(n))
+		d.Write(data[:n])
+		data = data[n:]
+	}
+}
+
+func writeCopies(d *bytes.Buffer, offset, length int) {
+	for length > 0 {
+		n := length
+		if n > maxCopy {
+			n = maxCopy
+		}
+		op := byte(0x80)
+		var args []byte
+		for j := uint(0); j < 4; j++ {
+			if b := byte(offset >> (j * 8)); b != 0 {
+				op |= 1 << j
+				args = append(args, b)
+			}
+		}
+		// a length of 0x10000 is encoded as no length bytes at all
+		if n != maxCopy {
+			for j := uint(0); j < 3; j++ {
+				if b := byte(n >> (j * 8)); b != 0 {
+					op |= 1 << (4 + j)
+					args = append(args, b)
+				}
+			}
+		}
+		d.WriteByte(op)
+		d.Write(args)
+		offset += n
+		length -= n
+	}
+}
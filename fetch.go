@@ -3,34 +3,89 @@ package git
 import (
 	"bufio"
 	"bytes"
-	"io"
+	"fmt"
 	"net/http"
-	"os"
+	"path"
+	"strings"
 )
 
-func Clone(url, path string) *Repo {
-	r := InitRepo(path, false)
+func Clone(url, path string) (*Repo, error) {
+	r, err := InitRepo(path, false)
+	if err != nil {
+		return nil, err
+	}
 	refsUrl := url + "/info/refs?service=git-upload-pack"
 	//resp, _, err := http.Get(url + "/info/refs?service=git-upload-pack")
 	resp, err := http.Get(refsUrl)
 	//resp, _, err := http.Get(url + "/info/refs?service=git-receive-pack")
 	if err != nil {
-		panic(err.Error())
-		return nil
+		return nil, err
 	}
+	defer resp.Body.Close()
 	buf := bufio.NewReader(resp.Body)
-	// TODO: check that this is the '#' packet
-	readPacket(buf)
-	// TODO: check that this is a flush
-	readPacket(buf)
-	refs := readRefs(buf)
+	// TODO: check that these are the '#' packet and a flush
+	for i := 0; i < 2; i++ {
+		if _, err := readPacket(buf); err != nil {
+			return nil, err
+		}
+	}
+	refs, err := readRefs(buf)
+	if err != nil {
+		return nil, err
+	}
 	b := bytes.NewBuffer(nil)
 	wants := make([]Id, 0, len(refs))
+	wanted := map[Id]bool{}
 	for _, id := range refs {
-		wants = append(wants, id)
+		if !wanted[id] {
+			wanted[id] = true
+			wants = append(wants, id)
+		}
+	}
+	if len(wants) == 0 {
+		// empty repository
+		return r, nil
 	}
-	writeWants(b, wants, nil)
+	// IndexPack can complete thin packs from objects we already have.
+	writeWants(b, wants, nil, []string{"ofs-delta", "thin-pack"})
 	resp, err = http.Post(url+"/git-upload-pack", "application/x-git-upload-pack-request", b)
-	io.Copy(os.Stdout, resp.Body)
-	return r
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	buf = bufio.NewReader(resp.Body)
+	packet, err := readPacket(buf)
+	if err != nil {
+		return nil, err
+	}
+	if string(packet) != "NAK\n" {
+		return nil, fmt.Errorf("git: expected NAK, got %q", packet)
+	}
+	if _, err := IndexPack(buf, r); err != nil {
+		return nil, err
+	}
+	if err := r.writeRefs(refs); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// writeRefs stores fetched refs as loose refs. Peeled tags and HEAD are
+// skipped, and so are names that aren't valid ref names, as git does, since
+// a name like refs/../config would write outside refs.
+func (r *Repo) writeRefs(refs map[string]Id) error {
+	for name, id := range refs {
+		if name == "HEAD" || strings.HasSuffix(name, "^{}") || !strings.HasPrefix(name, "refs/") || !validRefName(name) {
+			continue
+		}
+		name = r.file(name)
+		fsys := r.fsFor(name)
+		if err := fsys.MkdirAll(path.Dir(name), 0777); err != nil {
+			return err
+		}
+		if err := writeFile(fsys, name, []byte(id.String()+"\n"), 0666); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,160 @@
+package git
+
+// This file defines the file systems a Repo can live in, and implements the
+// one backed by the operating system.
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// A FileSystem is a writable file system in the style of fs.FS. Names are
+// slash-separated and relative to the root of the file system, as they are
+// for fs.FS, so they can't refer to anything outside it.
+type FileSystem interface {
+	fs.FS
+	// OpenFile opens name with flags from the os package, like os.OpenFile.
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	// TempFile creates a new file in the directory dir, like
+	// os.CreateTemp. The file's Name is its name in the file system.
+	TempFile(dir, pattern string) (File, error)
+	MkdirAll(name string, perm fs.FileMode) error
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	Chmod(name string, mode fs.FileMode) error
+}
+
+// A File is a file opened from a FileSystem.
+type File interface {
+	fs.File
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	// Name returns the name the file was opened with.
+	Name() string
+	Sync() error
+	Truncate(size int64) error
+}
+
+// writeFile writes data to name, creating it if necessary.
+func writeFile(fsys FileSystem, name string, data []byte, perm fs.FileMode) error {
+	f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// osFS is a FileSystem rooted at a directory on disk. Symbolic links are
+// followed even if they lead out of the directory.
+type osFS struct {
+	dir string
+}
+
+// NewOSFS returns a FileSystem for the directory dir.
+func NewOSFS(dir string) FileSystem {
+	return osFS{dir}
+}
+
+// osFile is an *os.File that remembers the name it was opened with.
+type osFile struct {
+	*os.File
+	name string
+}
+
+func (f osFile) Name() string { return f.name }
+
+func (o osFS) join(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(o.dir, filepath.FromSlash(name)), nil
+}
+
+func (o osFS) Open(name string) (fs.File, error) {
+	return o.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (o osFS) Stat(name string) (fs.FileInfo, error) {
+	full, err := o.join("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(full)
+}
+
+func (o osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	full, err := o.join("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(full)
+}
+
+func (o osFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	full, err := o.join("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(full, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{f, name}, nil
+}
+
+func (o osFS) TempFile(dir, pattern string) (File, error) {
+	full, err := o.join("createtemp", dir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(full, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{f, path.Join(dir, filepath.Base(f.Name()))}, nil
+}
+
+func (o osFS) MkdirAll(name string, perm fs.FileMode) error {
+	full, err := o.join("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(full, perm)
+}
+
+func (o osFS) Rename(oldname, newname string) error {
+	oldFull, err := o.join("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newFull, err := o.join("rename", newname)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldFull, newFull)
+}
+
+func (o osFS) Remove(name string) error {
+	full, err := o.join("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(full)
+}
+
+func (o osFS) Chmod(name string, mode fs.FileMode) error {
+	full, err := o.join("chmod", name)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(full, mode)
+}
@@ -0,0 +1,447 @@
+package git
+
+// This file implements checking a repository's objects, like git fsck.
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An FsckReport lists the problems Fsck found. Each list is sorted by id.
+type FsckReport struct {
+	Checked int // number of object copies read, loose and packed
+
+	// Corrupt objects can't be read, don't match their ids, are malformed,
+	// or point at objects of the wrong type. Refs that can't be resolved,
+	// such as malformed ones, are listed here too, with Ref set and no Id.
+	Corrupt []FsckObject
+	// Missing objects are referred to but aren't in the repository.
+	Missing []FsckObject
+	// Unreachable objects can't be reached from any ref or reflog entry.
+	Unreachable []FsckObject
+	// Dangling objects are the unreachable objects that no other
+	// unreachable object refers to.
+	Dangling []FsckObject
+}
+
+// An FsckObject is an object with a problem.
+type FsckObject struct {
+	Id   Id
+	Type ObjectType // zero if it isn't known
+	// For missing objects, what refers to them: either an object or a ref.
+	// Reflog entries are named like "logs/refs/heads/master". For broken
+	// refs, the ref.
+	From Id
+	Ref  string
+	Err  error // for corrupt objects, what's wrong
+}
+
+// OK reports whether the report has no corrupt or missing objects.
+// Unreachable objects are normal and aren't counted.
+func (f *FsckReport) OK() bool {
+	return len(f.Corrupt) == 0 && len(f.Missing) == 0
+}
+
+// fsckLink is a reference from one object to another.
+type fsckLink struct {
+	id      Id
+	objType ObjectType
+}
+
+type fsck struct {
+	repo   *Repo
+	report *FsckReport
+	types  map[Id]ObjectType // every object with a good copy
+	links  map[Id][]fsckLink
+
+	inAlternate bool        // whether objects are being read from an alternate
+	borrowed    map[Id]bool // objects only found in alternates
+}
+
+// Fsck checks every object in the repository, loose and packed. Each copy of
+// an object is read, hashed and parsed, and trees, commits and tags are
+// checked for the problems git fsck looks for. Then the objects reachable
+// from every ref and reflog entry are found. Objects in alternates are
+// checked and count as present, but aren't reported as unreachable, since
+// other repositories may need them. Problems are returned in the report; an
+// error means the repository couldn't be read at all.
+func (r *Repo) Fsck() (*FsckReport, error) {
+	f := &fsck{
+		repo:     r,
+		report:   &FsckReport{},
+		types:    map[Id]ObjectType{},
+		links:    map[Id][]fsckLink{},
+		borrowed: map[Id]bool{},
+	}
+	if s, ok := r.objects.(*FileStore); ok {
+		if err := f.checkFiles(s); err != nil {
+			return nil, err
+		}
+	} else {
+		err := r.objects.Iterate(func(id Id, objType ObjectType) error {
+			obj, err := r.objects.Get(id)
+			if err != nil {
+				f.check(id, 0, nil, err)
+			} else {
+				f.check(id, int(objType), obj.Raw(), nil)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// every link has to lead to an object of the right type
+	for from, links := range f.links {
+		for _, l := range links {
+			if t, ok := f.types[l.id]; !ok {
+				f.report.Missing = append(f.report.Missing, FsckObject{Id: l.id, Type: l.objType, From: from})
+			} else if l.objType != 0 && t != l.objType {
+				f.corrupt(from, f.types[from], fmt.Errorf("%w: %s points to %s %s", ErrCorruptObject, from, t, l.id))
+			}
+		}
+	}
+
+	reachable, err := f.reachable()
+	if err != nil {
+		return nil, err
+	}
+	referenced := map[Id]bool{}
+	for id := range f.types {
+		if !reachable[id] {
+			for _, l := range f.links[id] {
+				referenced[l.id] = true
+			}
+		}
+	}
+	for id, t := range f.types {
+		if reachable[id] || f.borrowed[id] {
+			continue
+		}
+		f.report.Unreachable = append(f.report.Unreachable, FsckObject{Id: id, Type: t})
+		if !referenced[id] {
+			f.report.Dangling = append(f.report.Dangling, FsckObject{Id: id, Type: t})
+		}
+	}
+
+	for _, list := range [][]FsckObject{f.report.Corrupt, f.report.Missing, f.report.Unreachable, f.report.Dangling} {
+		sort.Sort(fsckOrder(list))
+	}
+	return f.report, nil
+}
+
+type fsckOrder []FsckObject
+
+func (o fsckOrder) Len() int      { return len(o) }
+func (o fsckOrder) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o fsckOrder) Less(i, j int) bool {
+	if o[i].Id != o[j].Id {
+		return o[i].Id < o[j].Id
+	}
+	if o[i].From != o[j].From {
+		return o[i].From < o[j].From
+	}
+	return o[i].Ref < o[j].Ref
+}
+
+func (f *fsck) corrupt(id Id, objType ObjectType, err error) {
+	f.report.Corrupt = append(f.report.Corrupt, FsckObject{Id: id, Type: objType, Err: err})
+}
+
+// checkFiles checks every copy of every object in s and its alternates.
+func (f *fsck) checkFiles(s *FileStore) error {
+	stores, err := s.stores()
+	if err != nil {
+		return err
+	}
+	for i, st := range stores {
+		f.inAlternate = i > 0
+		if err := f.checkStore(st); err != nil {
+			return err
+		}
+	}
+	f.inAlternate = false
+	return nil
+}
+
+// checkStore checks the objects in s itself.
+func (f *fsck) checkStore(s *FileStore) error {
+	loose, err := s.looseIds()
+	if err != nil {
+		return err
+	}
+	for _, id := range loose {
+		objType, content, err := s.readLoose(id)
+		f.check(id, objType, content, err)
+	}
+	packs, err := s.findPacks()
+	if err != nil {
+		return err
+	}
+	for _, p := range packs {
+		if err := p.readIndex(); err != nil {
+			return err
+		}
+		for n := uint32(0); n < p.count; n++ {
+			id := Id(string(p.idAt(n)))
+			offset, err := p.offsetAt(n)
+			var objType int
+			var content []byte
+			if err == nil {
+				objType, content, err = p.readRaw(offset, 0)
+			}
+			f.check(id, objType, content, err)
+		}
+	}
+	return nil
+}
+
+// check checks one copy of an object, which was read with the given error.
+func (f *fsck) check(id Id, objType int, content []byte, err error) {
+	f.report.Checked++
+	if err != nil {
+		f.corrupt(id, 0, err)
+		return
+	}
+	t := ObjectType(objType)
+	h := sha1.New()
+	h.Write([]byte(t.String() + " " + strconv.Itoa(len(content)) + "\x00"))
+	h.Write(content)
+	if Id(string(h.Sum(nil))) != id {
+		f.corrupt(id, t, corrupt("%s: contents don't match id", id))
+		return
+	}
+	obj, err := parseContent(objType, content)
+	if err == nil {
+		err = checkObject(obj)
+	}
+	if err != nil {
+		f.corrupt(id, t, fmt.Errorf("%s: %w", id, err))
+		return
+	}
+	if _, ok := f.types[id]; ok {
+		// another copy was already checked
+		return
+	}
+	f.types[id] = t
+	if f.inAlternate {
+		f.borrowed[id] = true
+	}
+
+	var links []fsckLink
+	switch o := obj.(type) {
+	case *Tree:
+		for _, e := range o.entries {
+			switch {
+			case e.Mode == ModeGitlink:
+				// submodule commits live in another repository
+			case e.Mode.IsDir():
+				links = append(links, fsckLink{e.Id, TreeObject})
+			default:
+				links = append(links, fsckLink{e.Id, BlobObject})
+			}
+		}
+	case *Commit:
+		links = append(links, fsckLink{o.tree, TreeObject})
+		for _, p := range o.parents {
+			links = append(links, fsckLink{p, CommitObject})
+		}
+	case *Tag:
+		links = append(links, fsckLink{o.object, ObjectType(objectTypeCode(o.objType))})
+	}
+	if len(links) > 0 {
+		f.links[id] = links
+	}
+}
+
+// reachable returns the objects that can be reached from refs and reflogs,
+// and records any roots that are missing.
+func (f *fsck) reachable() (map[Id]bool, error) {
+	roots := map[Id][]string{}
+	refs, broken, err := f.repo.listRefs()
+	if err != nil {
+		return nil, err
+	}
+	for name, err := range broken {
+		f.report.Corrupt = append(f.report.Corrupt, FsckObject{Ref: name, Err: err})
+	}
+	for name, id := range refs {
+		roots[id] = append(roots[id], name)
+	}
+	// a linked worktree keeps its HEAD's log apart from the shared logs
+	logs := []FileSystem{f.repo.fs}
+	if f.repo.common != nil {
+		logs = append(logs, f.repo.common)
+	}
+	for _, fsys := range logs {
+		err = fs.WalkDir(fsys, "logs", func(name string, d fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) && name == "logs" {
+				return nil
+			} else if err != nil || d.IsDir() {
+				return err
+			}
+			content, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return err
+			}
+			entries, err := parseReflog(strings.TrimPrefix(name, "logs/"), content)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				for _, id := range []Id{e.old, e.new} {
+					// a ref's log usually mentions each id twice
+					names := roots[id]
+					if id != zeroId && (len(names) == 0 || names[len(names)-1] != name) {
+						roots[id] = append(names, name)
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reachable := map[Id]bool{}
+	var queue []Id
+	for id, names := range roots {
+		if _, ok := f.types[id]; !ok {
+			for _, name := range names {
+				f.report.Missing = append(f.report.Missing, FsckObject{Id: id, Ref: name})
+			}
+			continue
+		}
+		reachable[id] = true
+		queue = append(queue, id)
+	}
+	for len(queue) > 0 {
+		id := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		for _, l := range f.links[id] {
+			if _, ok := f.types[l.id]; ok && !reachable[l.id] {
+				reachable[l.id] = true
+				queue = append(queue, l.id)
+			}
+		}
+	}
+	return reachable, nil
+}
+
+// checkObject looks for problems in a parsed object that parsing tolerates.
+func checkObject(obj Object) error {
+	switch o := obj.(type) {
+	case *Tree:
+		return checkTree(o)
+	case *Commit:
+		return checkCommit(o)
+	case *Tag:
+		return checkTag(o)
+	}
+	return nil
+}
+
+func checkTree(t *Tree) error {
+	for i, e := range t.entries {
+		switch e.Mode {
+		case ModeFile, ModeExecutable, ModeSymlink, ModeDir, ModeGitlink:
+		case 0100664:
+			// written by some early versions of git
+		default:
+			return corrupt("tree entry %q has bad mode %s", e.Name, e.Mode)
+		}
+		switch {
+		case e.Name == "" || e.Name == "." || e.Name == ".." || strings.EqualFold(e.Name, ".git"):
+			return corrupt("tree has bad entry name %q", e.Name)
+		case strings.IndexByte(e.Name, '/') >= 0:
+			return corrupt("tree entry %q contains a slash", e.Name)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := t.entries[i-1]
+		if prev.Name == e.Name {
+			return corrupt("tree has duplicate entry %q", e.Name)
+		}
+		if treeSortKey(prev) >= treeSortKey(e) {
+			return corrupt("tree isn't sorted at %q", e.Name)
+		}
+	}
+	return nil
+}
+
+func checkCommit(c *Commit) error {
+	// tree, parents, author and committer come first, in that order
+	h := c.headers
+	if len(h) == 0 || h[0].Key != "tree" {
+		return corrupt("commit doesn't start with a tree")
+	}
+	h = h[1:]
+	for len(h) > 0 && h[0].Key == "parent" {
+		h = h[1:]
+	}
+	for _, key := range []string{"author", "committer"} {
+		if len(h) == 0 || h[0].Key != key {
+			return corrupt("commit is missing its %s", key)
+		}
+		if err := checkIdent(h[0].Value); err != nil {
+			return err
+		}
+		h = h[1:]
+	}
+	return nil
+}
+
+func checkTag(t *Tag) error {
+	h := t.headers
+	for _, key := range []string{"object", "type", "tag"} {
+		if len(h) == 0 || h[0].Key != key {
+			return corrupt("tag is missing its %s", key)
+		}
+		h = h[1:]
+	}
+	if objectTypeCode(t.objType) == 0 {
+		return corrupt("tag has bad type %q", t.objType)
+	}
+	// very old tags don't have a tagger
+	if len(h) > 0 && h[0].Key == "tagger" {
+		return checkIdent(h[0].Value)
+	}
+	return nil
+}
+
+// checkIdent checks an identity line strictly; parseSignature is lenient
+// about dates.
+func checkIdent(s string) error {
+	bad := corrupt("bad identity %q", s)
+	lt := strings.IndexByte(s, '<')
+	gt := strings.IndexByte(s, '>')
+	if lt < 0 || gt < lt || strings.IndexByte(s[lt+1:], '<') >= 0 || strings.IndexByte(s[gt+1:], '>') >= 0 {
+		return bad
+	}
+	if lt > 0 && s[lt-1] != ' ' {
+		return bad
+	}
+	fields := strings.Split(s[gt+1:], " ")
+	if len(fields) != 3 || fields[0] != "" {
+		return bad
+	}
+	if _, err := strconv.ParseUint(fields[1], 10, 64); err != nil {
+		return bad
+	}
+	tz := fields[2]
+	if len(tz) != 5 || (tz[0] != '+' && tz[0] != '-') {
+		return bad
+	}
+	if _, err := strconv.ParseUint(tz[1:], 10, 32); err != nil {
+		return bad
+	}
+	return nil
+}
@@ -2,18 +2,49 @@ package git
 
 import (
 	"bytes"
-	"compress/zlib"
 	"encoding/hex"
-	"io/ioutil"
-	"os"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+var (
+	// ErrObjectNotFound is returned when an object is in neither loose nor packed storage.
+	ErrObjectNotFound = errors.New("git: object not found")
+	// ErrCorruptObject is returned when an object's contents can't be parsed.
+	ErrCorruptObject = errors.New("git: corrupt object")
+	// ErrBadPackHeader is returned when a pack or pack index has an unrecognized header.
+	ErrBadPackHeader = errors.New("git: bad pack header")
+	// ErrNotARepo is returned when a directory doesn't look like a git repository.
+	ErrNotARepo = errors.New("git: not a git repository")
+	// ErrAmbiguousId is returned when an abbreviated object id matches more than one object.
+	ErrAmbiguousId = errors.New("git: ambiguous object id")
+	// ErrUnknownRevision is returned when a revision names neither a ref nor an object.
+	ErrUnknownRevision = errors.New("git: unknown revision")
+)
+
+// corrupt returns an error wrapping ErrCorruptObject with some context.
+func corrupt(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrCorruptObject, fmt.Sprintf(format, args...))
+}
+
+// A Repo is a git repository. It's safe to use from several goroutines at
+// once.
 type Repo struct {
-	path  string
-	packs []*pack
-	refs  map[string]Id
+	path    string // the repository's directory, if it's on disk
+	fs      FileSystem
+	common  FileSystem // the main repository's directory, for a linked worktree
+	objects ObjectStore
+	mu      sync.Mutex // guards cache
+	cache   *lru       // parsed objects, if SetObjectCacheSize turned it on
+	bare    bool
+	workDir string
 }
 
 // A git repository requires:
@@ -21,13 +52,24 @@ type Repo struct {
 // - A refs directory
 // - Either a HEAD symlink or a HEAD file that is formatted properly
 func IsRepo(dir string) bool {
+	return isRepo(NewOSFS(dir))
+}
+
+func isRepo(fsys FileSystem) bool {
+	return isRepoFS(fsys, fsys, false)
+}
+
+// isRepoFS is like isRepo, but for a repository whose HEAD is in fsys and
+// whose refs and objects are in common, as they are for a linked worktree.
+// If objects is true, there doesn't need to be an objects directory.
+func isRepoFS(fsys, common FileSystem, objects bool) bool {
 	// TODO: Check for symlink?
-	head, err := ioutil.ReadFile(dir + "/HEAD")
+	head, err := fs.ReadFile(fsys, "HEAD")
 	if err != nil {
 		return false
 	}
 	// We'll just assume that anything starting with "ref: " is good enough
-	if string(head[:5]) != "ref: " {
+	if !bytes.HasPrefix(head, []byte("ref: ")) {
 		for _, c := range head {
 			if c < '0' || c > 'f' || (c > '9' && c < 'a') {
 				// Not a valid SHA-1
@@ -35,195 +77,385 @@ func IsRepo(dir string) bool {
 			}
 		}
 	}
-	stat, err := os.Lstat(dir + "/objects")
-	if err != nil || !stat.IsDir() {
-		return false
+	if !objects {
+		stat, err := fs.Stat(common, "objects")
+		if err != nil || !stat.IsDir() {
+			return false
+		}
 	}
-	stat, err = os.Lstat(dir + "/refs")
+	stat, err := fs.Stat(common, "refs")
 	if err != nil || !stat.IsDir() {
 		return false
 	}
 	return true
 }
 
-// Create .git directory
-// Create empty .git/objects, .git/refs
-// Create HEAD containing "ref: refs/heads/master"
-func InitRepo(path string, bare bool) *Repo {
-	r := NewRepo(path)
-	if r != nil {
-		return r
+// NewRepo opens the repository at path, which must be the .git directory
+// itself. It returns ErrNotARepo if path doesn't look like a repository.
+func NewRepo(path string) (*Repo, error) {
+	fsys := NewOSFS(path)
+	if !isRepo(fsys) {
+		return nil, fmt.Errorf("%w: %s", ErrNotARepo, path)
 	}
-	r = &Repo{path: path}
-	os.Mkdir(path, 0666)
-	os.Mkdir(r.file("/objects"), 0666)
-	os.Mkdir(r.file("refs"), 0666)
-	ioutil.WriteFile(r.file("/HEAD"), []byte("ref: refs/heads/master"), 0666)
+	return openRepo(fsys, path), nil
+}
+
+// NewRepoFS opens the repository at the root of fsys.
+func NewRepoFS(fsys FileSystem) (*Repo, error) {
+	if !isRepo(fsys) {
+		return nil, ErrNotARepo
+	}
+	return openRepo(fsys, ""), nil
+}
+
+// openRepo opens the repository at the root of fsys, which is at path on
+// disk unless path is "".
+func openRepo(fsys FileSystem, path string) *Repo {
+	r := NewRepoWithStore(fsys, NewFileStoreFS(fsys, "objects"))
+	r.path = path
+	r.readBare()
 	return r
 }
 
-func NewRepo(path string) *Repo {
-	if !IsRepo(path) {
-		return nil
+// NewRepoWithStore returns a repository whose refs are at the root of fsys
+// but whose objects are kept in objects. The file system isn't checked.
+func NewRepoWithStore(fsys FileSystem, objects ObjectStore) *Repo {
+	return &Repo{fs: fsys, objects: objects, bare: true}
+}
+
+// readBare sets whether r is bare from its core.bare setting, or else
+// guesses from its name: a repository in a directory named .git has a
+// working tree, which is the directory above. A config that can't be read
+// is treated like one without core.bare, so that it doesn't stop the
+// repository from being opened; it's reported by whatever needs it next.
+func (r *Repo) readBare() {
+	c, err := readConfig(r.fsFor("config"), "config")
+	if err != nil {
+		c = config{}
+	}
+	bare, ok := c.bool("core.bare")
+	if !ok {
+		bare = r.workDir == "" && filepath.Base(r.path) != ".git"
+	}
+	r.bare = bare
+	if bare {
+		r.workDir = ""
+	} else if r.workDir == "" && r.path != "" {
+		r.workDir = filepath.Dir(r.path)
+	}
+}
+
+// IsBare reports whether r is a bare repository, one without a working
+// tree.
+func (r *Repo) IsBare() bool {
+	return r.bare
+}
+
+// WorkDir returns the directory of r's working tree, or "" if r is bare or
+// isn't on disk.
+func (r *Repo) WorkDir() string {
+	return r.workDir
+}
+
+// file returns the name in r's file system of a file in the repository,
+// given as a slash-separated path.
+func (r *Repo) file(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// Objects returns the store that holds the repository's objects.
+func (r *Repo) Objects() ObjectStore {
+	return r.objects
+}
+
+// ForEachObject calls fn once for every object in the repository,
+// including those it borrows from alternates, and stops at the first error
+// fn returns. For repositories on disk, loose objects come first, and then
+// the objects in each pack in index order. An object that's stored more
+// than once is only visited the first time.
+func (r *Repo) ForEachObject(fn func(id Id, objType ObjectType) error) error {
+	seen := map[Id]bool{}
+	return r.objects.Iterate(func(id Id, objType ObjectType) error {
+		if seen[id] {
+			return nil
+		}
+		seen[id] = true
+		return fn(id, objType)
+	})
+}
+
+// GetObject returns the object with the given id. It returns an error
+// wrapping ErrObjectNotFound if the object isn't in the repository.
+func (r *Repo) GetObject(id Id) (Object, error) {
+	r.mu.Lock()
+	cache := r.cache
+	r.mu.Unlock()
+	if cache == nil {
+		return r.objects.Get(id)
+	}
+	if obj, ok := cache.get(id); ok {
+		return obj.(Object), nil
+	}
+	obj, err := r.objects.Get(id)
+	if err != nil {
+		return nil, err
 	}
-	return &Repo{path: path}
+	cache.add(id, obj, 1)
+	return obj, nil
 }
 
-func (r *Repo) file(path string) string {
-	return filepath.Join(r.path, path)
+// Stat returns the type and size of the object with the given id. Only the
+// object's header is read, so this is much cheaper than GetObject.
+func (r *Repo) Stat(id Id) (ObjectType, int64, error) {
+	return r.objects.Stat(id)
 }
 
-func (r *Repo) GetObject(id Id) Object {
-	obj := r.getLooseObject(id)
-	if obj == nil {
-		obj = r.getPackedObject(id)
+// Has reports whether the repository contains an object with the given id.
+func (r *Repo) Has(id Id) bool {
+	return r.objects.Has(id)
+}
+
+// Save adds an Object to the repository and returns its Id. Objects that
+// are already in the repository aren't written again.
+func (r *Repo) Save(obj Object) (Id, error) {
+	return r.objects.Put(obj)
+}
+
+func parse(raw []byte) (Object, error) {
+	objType, content, err := splitHeader(raw)
+	if err != nil {
+		return nil, err
 	}
-	return obj
+	return parseContent(objType, content)
 }
 
-func parse(raw []byte) Object {
+// splitHeader splits a loose object's "type size\x00" header from its
+// contents and returns the type as a pack type code.
+func splitHeader(raw []byte) (int, []byte, error) {
 	i := bytes.IndexByte(raw, ' ')
 	null := bytes.IndexByte(raw, '\x00')
-	sizeStr := raw[i+1 : null]
-	size, err := strconv.Atoi(string(sizeStr))
-	if err != nil {
-		panic("whaa?")
+	if i < 0 || null < i {
+		return 0, nil, corrupt("malformed object header")
+	}
+	size, err := strconv.Atoi(string(raw[i+1 : null]))
+	if err != nil || size < 0 || size > len(raw)-null-1 {
+		return 0, nil, corrupt("bad object size %q", raw[i+1:null])
+	}
+	objType := objectTypeCode(string(raw[:i]))
+	if objType == 0 {
+		return 0, nil, corrupt("unknown object type %q", raw[:i])
 	}
-	switch string(raw[:i]) {
-	case "blob":
-		return &Blob{raw[null+1 : null+1+size]}
-	case "tree":
-		return parseTree(raw[null+1 : null+1+size])
-	case "commit":
-		return parseCommit(raw[null+1 : null+1+size])
-	default:
-		panic("What the heck?")
+	return objType, raw[null+1 : null+1+size], nil
+}
+
+// parseContent parses the contents of an object of the given pack type code.
+func parseContent(objType int, content []byte) (Object, error) {
+	switch objType {
+	case _OBJ_COMMIT:
+		return parseCommit(content)
+	case _OBJ_TREE:
+		return parseTree(content)
+	case _OBJ_BLOB:
+		return &Blob{content}, nil
+	case _OBJ_TAG:
+		return parseTag(content)
 	}
-	return nil
+	return nil, corrupt("unsupported object type %d", objType)
 }
 
-func parseTree(raw []byte) *Tree {
-	t := NewTree(0)
+func parseTree(raw []byte) (*Tree, error) {
+	t := &Tree{modes: []string{}}
 	for len(raw) > 0 {
+		space := bytes.IndexByte(raw, ' ')
 		pos := bytes.IndexByte(raw, 0)
-		name := string(raw[7:pos])
+		if space < 1 || pos < space || len(raw) < pos+21 {
+			return nil, corrupt("truncated tree entry")
+		}
+		mode, err := strconv.ParseUint(string(raw[:space]), 8, 32)
+		if err != nil {
+			return nil, corrupt("bad tree entry mode %q", raw[:space])
+		}
+		name := string(raw[space+1 : pos])
 		id := Id(string(raw[pos+1 : pos+21]))
+		t.entries = append(t.entries, TreeEntry{name, FileMode(mode), id})
+		t.modes = append(t.modes, string(raw[:space]))
 		raw = raw[pos+21:]
-		t.Add(name, id)
 	}
-	return t
+	return t, nil
 }
 
-func parseCommit(raw []byte) *Commit {
-	msgPos := bytes.Index(raw, []byte("\n\n"))
-	if msgPos < 0 {
-		panic("no message?")
-	}
-	lines := bytes.Split(raw[:msgPos], []byte{'\n'})
-	c := &Commit{}
-	for _, line := range lines {
+// parseHeaders parses the header lines of a commit or tag, which end at the
+// first blank line. It returns the headers and the rest of raw.
+func parseHeaders(raw []byte) ([]ExtraHeader, []byte, error) {
+	var headers []ExtraHeader
+	for {
+		nl := bytes.IndexByte(raw, '\n')
+		if nl < 0 {
+			return nil, nil, corrupt("no blank line after headers")
+		}
+		line := raw[:nl]
+		raw = raw[nl+1:]
+		if len(line) == 0 {
+			return headers, raw, nil
+		}
+		if line[0] == ' ' {
+			if len(headers) == 0 {
+				return nil, nil, corrupt("continuation line before first header")
+			}
+			h := &headers[len(headers)-1]
+			h.Value += "\n" + string(line[1:])
+			continue
+		}
 		pos := bytes.IndexByte(line, ' ')
 		if pos < 0 {
-			panic("bad commit format")
+			return nil, nil, corrupt("bad header %q", line)
 		}
-		switch string(line[:pos]) {
+		headers = append(headers, ExtraHeader{string(line[:pos]), string(line[pos+1:])})
+	}
+}
+
+func parseCommit(raw []byte) (*Commit, error) {
+	headers, msg, err := parseHeaders(raw)
+	if err != nil {
+		return nil, err
+	}
+	c := &Commit{headers: headers, msg: string(msg)}
+	for _, h := range headers {
+		switch h.Key {
 		case "tree":
-			c.tree = IdFromBytes(line[pos+1:])
+			c.tree = IdFromString(h.Value)
+			if c.tree == "" {
+				return nil, corrupt("bad commit tree %q", h.Value)
+			}
 		case "parent":
-			parentId := IdFromBytes(line[pos+1:])
+			parentId := IdFromString(h.Value)
+			if parentId == "" {
+				return nil, corrupt("bad commit parent %q", h.Value)
+			}
 			c.parents = append(c.parents, parentId)
 		case "author":
-			c.authorName, c.authorEmail = parseIdentity(line[pos+1:])
+			c.author, err = parseSignature([]byte(h.Value))
 		case "committer":
-			c.committerName, c.committerEmail = parseIdentity(line[pos+1:])
+			c.committer, err = parseSignature([]byte(h.Value))
+		}
+		if err != nil {
+			return nil, err
 		}
 	}
-	c.msg = string(raw[msgPos+2:])
-	return c
+	return c, nil
 }
 
-func parseIdentity(line []byte) (string, string) {
+// parseSignature parses an identity line of the form
+// "Name <email> 1234567890 +0100".
+func parseSignature(line []byte) (Signature, error) {
+	var sig Signature
 	pos := bytes.IndexByte(line, '<')
-	name := string(line[:pos-1])
-	addrEnd := bytes.IndexByte(line, '>')
-	addr := string(line[pos+1 : addrEnd])
-	return name, addr
+	addrEnd := bytes.IndexByte(line[pos+1:], '>') + pos + 1
+	if pos < 0 || addrEnd <= pos {
+		return sig, corrupt("bad identity %q", line)
+	}
+	sig.Name = string(bytes.TrimRight(line[:pos], " "))
+	sig.Email = string(line[pos+1 : addrEnd])
+	// Some old or broken tools wrote bogus dates. They're left as the zero
+	// time rather than making the whole object unreadable.
+	fields := bytes.Fields(line[addrEnd+1:])
+	if len(fields) != 2 {
+		return sig, nil
+	}
+	seconds, err := strconv.ParseInt(string(fields[0]), 10, 64)
+	if err != nil {
+		return sig, nil
+	}
+	offset := 0
+	if tz := fields[1]; len(tz) == 5 && (tz[0] == '+' || tz[0] == '-') {
+		if hhmm, err := strconv.Atoi(string(tz[1:])); err == nil {
+			offset = (hhmm/100*60 + hhmm%100) * 60
+		}
+		if tz[0] == '-' {
+			offset = -offset
+		}
+	}
+	sig.When = time.Unix(seconds, 0).In(time.FixedZone("", offset))
+	return sig, nil
 }
 
-func (r *Repo) loosePath(id Id) string {
-	sha1 := id.String()
-	return filepath.Join(r.file("objects"), sha1[0:2], sha1[2:])
+// pgpSignatureHeaders are the lines that can begin a signature appended to a
+// tag message.
+var pgpSignatureHeaders = []string{
+	"-----BEGIN PGP SIGNATURE-----",
+	"-----BEGIN PGP MESSAGE-----",
+	"-----BEGIN SSH SIGNATURE-----",
 }
 
-func (r *Repo) getLooseObject(id Id) Object {
-	path := r.loosePath(id)
-	f, err := os.Open(path)
+func parseTag(raw []byte) (*Tag, error) {
+	headers, rest, err := parseHeaders(raw)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	defer f.Close()
-	z, err := zlib.NewReader(f)
-	if err != nil {
-		panic("Error in zlib:" + err.Error())
-	}
-	defer z.Close()
-	// TODO: Size it right
-	b := make([]byte, 1024)
-	z.Read(b)
-	return parse(b)
-}
-
-// parse and cache index info
-func (r *Repo) findPacks() {
-	if len(r.packs) > 0 {
-		// TODO: it's probably legal to have 0 packs
-		return
+	t := &Tag{headers: headers}
+	for _, h := range headers {
+		switch h.Key {
+		case "object":
+			t.object = IdFromString(h.Value)
+			if t.object == "" {
+				return nil, corrupt("bad tag object %q", h.Value)
+			}
+		case "type":
+			t.objType = h.Value
+		case "tag":
+			t.name = h.Value
+		case "tagger":
+			sig, err := parseSignature([]byte(h.Value))
+			if err != nil {
+				return nil, err
+			}
+			t.tagger = &sig
+		}
 	}
-	packDir := filepath.Join(r.file("objects"), "pack")
-	dir, err := os.Open(packDir)
-	if err != nil {
-		panic(err.Error())
-		return
+	if t.object == "" || t.objType == "" {
+		return nil, corrupt("tag is missing object or type")
 	}
-	defer dir.Close()
-	files, err := dir.Readdirnames(-1)
-	if err != nil {
-		panic(err.Error())
-		return
-	}
-	for _, f := range files {
-		ext := filepath.Ext(f)
-		if ext == ".idx" {
-			base := f[:len(f)-len(ext)]
-			r.packs = append(r.packs, newPack(r, base))
+	msg := string(rest)
+	// The signature starts at the last line that looks like an armor header.
+	sigPos := -1
+	for i := 0; i < len(msg); {
+		for _, h := range pgpSignatureHeaders {
+			if strings.HasPrefix(msg[i:], h) {
+				sigPos = i
+			}
+		}
+		nl := strings.IndexByte(msg[i:], '\n')
+		if nl < 0 {
+			break
 		}
+		i += nl + 1
 	}
+	if sigPos >= 0 {
+		t.msg, t.signature = msg[:sigPos], msg[sigPos:]
+	} else {
+		t.msg = msg
+	}
+	return t, nil
 }
 
-func (r *Repo) getPackedObject(id Id) Object {
-	r.findPacks()
-	for _, p := range r.packs {
-		if obj := p.getObject(id); obj != nil {
-			return obj
+// Peel follows a chain of tags starting at obj and returns the first object
+// that isn't a tag. If obj isn't a tag, it's returned as-is.
+func (r *Repo) Peel(obj Object) (Object, error) {
+	for {
+		tag, ok := obj.(*Tag)
+		if !ok {
+			return obj, nil
+		}
+		var err error
+		obj, err = r.GetObject(tag.object)
+		if err != nil {
+			return nil, err
 		}
 	}
-	return nil
-}
-
-// Save adds an Object to the repository.
-func (r *Repo) Save(obj Object) error {
-	// It's easy to create a loose object. Let's do that.
-	path := r.loosePath(ObjectId(obj))
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	content := obj.Raw()
-	wr := zlib.NewWriter(f)
-	defer wr.Close()
-	wr.Write(content)
-	return nil
 }
 
 // binary representation of an id
@@ -1,7 +1,24 @@
 package git
 
 import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 var varintTests = []struct {
@@ -25,6 +42,64 @@ func TestVarint(t *testing.T) {
 	}
 }
 
+func TestErrors(t *testing.T) {
+	if _, err := NewRepo("testdata/nonexistent"); !errors.Is(err, ErrNotARepo) {
+		t.Errorf("NewRepo: got %v, wanted ErrNotARepo", err)
+	}
+	r, err := InitRepo(filepath.Join(t.TempDir(), "repo"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.GetObject(IdFromString("0123456789012345678901234567890123456789"))
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("GetObject: got %v, wanted ErrObjectNotFound", err)
+	}
+	for _, id := range []Id{"", IdFromString("zz"), "short"} {
+		if _, err := r.GetObject(id); !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("GetObject(%q): got %v, wanted ErrObjectNotFound", id, err)
+		}
+		if _, _, err := r.Stat(id); !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("Stat(%q): got %v, wanted ErrObjectNotFound", id, err)
+		}
+		if r.Has(id) {
+			t.Errorf("Has(%q) = true", id)
+		}
+	}
+	// symbolic refs that point at each other, and one that points nowhere
+	for name, content := range map[string]string{
+		"HEAD":         "refs/heads/a",
+		"refs/heads/a": "refs/heads/b",
+		"refs/heads/b": "refs/heads/a",
+		"refs/tags/c":  "refs/heads/gone",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(r.path, name), []byte("ref: "+content+"\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.Head(); err == nil || !strings.Contains(err.Error(), "symbolic refs") {
+		t.Errorf("Head with a symref loop: got %v", err)
+	}
+	if refs, err := r.Refs(); err != nil || len(refs) != 0 {
+		t.Errorf("Refs with broken refs = %v, %v", refs, err)
+	}
+	if _, err := readPacket(strings.NewReader("0016ERR access denied\n")); err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("readPacket of an ERR packet: got %v", err)
+	}
+	for _, raw := range []string{"", "blob", "blob 5\x00abc", "blob x\x00", "frob 0\x00", "commit 3\x00abc", "tree 5\x00abcde"} {
+		if _, err := parse([]byte(raw)); !errors.Is(err, ErrCorruptObject) {
+			t.Errorf("parse(%q): got %v, wanted ErrCorruptObject", raw, err)
+		}
+	}
+	for _, delta := range [][]byte{
+		{3, 4, 0x91, 0, 4},
+		{3, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x40, 0x91, 0, 4}, // a result of 1<<62 bytes
+	} {
+		if _, err := applyDelta([]byte("abc"), delta); !errors.Is(err, ErrCorruptObject) {
+			t.Errorf("applyDelta(%v): got %v, wanted ErrCorruptObject", delta, err)
+		}
+	}
+}
+
 /*
 func TestClone(t *testing.T) {
 	Clone("http://github.com/edsrzf/go-git.git", "clonedrepo")
@@ -33,32 +108,1709 @@ func TestClone(t *testing.T) {
 
 // It's probably a bad idea to write tests this way, but it's just so convenient.
 func TestObjects(t *testing.T) {
-	r := NewRepo(".git")
-	if r == nil {
-		t.Fatal("cannot find repo")
+	r, err := NewRepo(".git")
+	if err != nil {
+		t.Fatal(err)
 	}
 	id := IdFromString("5740508db83a6f137c346e240607f51261633e51")
 
-	obj := r.GetObject(id)
+	obj, err := r.GetObject(id)
+	if err != nil {
+		t.Error(err)
+	}
 	if _, ok := obj.(*Commit); !ok {
 		t.Errorf("%s isn't a commit!", id)
 	}
 
 	id = IdFromString("80d3035b39f0f6346a1b666c9bc49896c41e89df")
-	obj = r.GetObject(id)
+	obj, err = r.GetObject(id)
+	if err != nil {
+		t.Error(err)
+	}
 	if _, ok := obj.(*Tree); !ok {
 		t.Errorf("%s isn't a tree!", id)
 	}
 
 	id = IdFromString("f9f3ec33496f036295663b178b96f6863c303b8f")
-	obj = r.GetObject(id)
+	obj, err = r.GetObject(id)
+	if err != nil {
+		t.Error(err)
+	}
 	if _, ok := obj.(*Blob); !ok {
 		t.Errorf("%s isn't a blob!", id)
 	}
 
 	id = IdFromString("020ec0fea03988331291de2148f52c0b2351fbbe")
-	obj = r.GetObject(id)
+	obj, err = r.GetObject(id)
+	if err != nil {
+		t.Error(err)
+	}
 	if _, ok := obj.(*Blob); !ok {
 		t.Errorf("%s isn't a blob!", id)
 	}
 }
+
+func TestTag(t *testing.T) {
+	raw := "object 55109e9f6f3c0456cc8e52f990adea2a90f9b75d\n" +
+		"type commit\n" +
+		"tag v1.0\n" +
+		"tagger A U Thor <a@x.com> 1234567890 -0130\n" +
+		"\n" +
+		"Release 1.0\n"
+	obj, err := parse([]byte("tag " + strconv.Itoa(len(raw)) + "\x00" + raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, ok := obj.(*Tag)
+	if !ok {
+		t.Fatalf("got %T, wanted *Tag", obj)
+	}
+	if tag.Name() != "v1.0" || tag.TargetType() != "commit" || tag.Message() != "Release 1.0\n" {
+		t.Errorf("bad tag fields: %q %q %q", tag.Name(), tag.TargetType(), tag.Message())
+	}
+	if tag.Target().String() != "55109e9f6f3c0456cc8e52f990adea2a90f9b75d" {
+		t.Errorf("bad target %s", tag.Target())
+	}
+	tagger := tag.Tagger()
+	if tagger == nil || tagger.Name != "A U Thor" || tagger.Email != "a@x.com" {
+		t.Fatalf("bad tagger %v", tagger)
+	}
+	if _, offset := tagger.When.Zone(); tagger.When.Unix() != 1234567890 || offset != -90*60 {
+		t.Errorf("bad tagger time %v", tagger.When)
+	}
+	if id := ObjectId(tag).String(); id != "b783ea13b2d9444b7ae1cf613665b5b42e29a502" {
+		t.Errorf("got id %s", id)
+	}
+
+	signed := raw + "-----BEGIN PGP SIGNATURE-----\n\nabc\n-----END PGP SIGNATURE-----\n"
+	tag, err = parseTag([]byte(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Message() != "Release 1.0\n" || !strings.HasPrefix(tag.Signature(), "-----BEGIN PGP SIGNATURE-----\n") {
+		t.Errorf("bad message/signature split: %q %q", tag.Message(), tag.Signature())
+	}
+	if string(tag.Raw()) != signed {
+		t.Errorf("signed tag didn't round-trip:\n%s", tag.Raw())
+	}
+}
+
+func TestTree(t *testing.T) {
+	blob := IdFromString("45b983be36b73c0788dc9cbcb76cbb80fc7bb057")
+	sub := NewTree(1)
+	sub.Add("foo", ModeFile, blob)
+	if id := ObjectId(sub).String(); id != "d5d3ae9b365275c0d3657f4add7a4dbdf960f783" {
+		t.Fatalf("got subtree id %s", id)
+	}
+
+	tree := NewTree(0)
+	tree.Add("foo.c", ModeFile, blob)
+	tree.Add("foo", ModeDir, ObjectId(sub))
+	tree.Add("run", ModeExecutable, blob)
+	tree.Add("link", ModeSymlink, blob)
+	tree.Add("sub", ModeGitlink, IdFromString("55109e9f6f3c0456cc8e52f990adea2a90f9b75d"))
+	tree.Add("foo-bar", ModeFile, blob)
+	id := ObjectId(tree)
+	if id.String() != "ea7167225e3c2189b2b6bfd6554f9996726e0b1d" {
+		t.Errorf("got tree id %s", id)
+	}
+
+	wantOrder := []string{"foo-bar", "foo.c", "foo", "link", "run", "sub"}
+	for i, e := range tree.Entries() {
+		if e.Name != wantOrder[i] {
+			t.Errorf("entry %d: got %s, wanted %s", i, e.Name, wantOrder[i])
+		}
+	}
+
+	parsed, err := parseTree(tree.Raw())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ObjectId(parsed) != id {
+		t.Errorf("tree didn't round-trip")
+	}
+	if e, ok := parsed.Lookup("run"); !ok || e.Mode != ModeExecutable {
+		t.Errorf("Lookup(run) = %v, %v", e, ok)
+	}
+	if e, _ := parsed.Lookup("foo"); !e.Mode.IsDir() || e.Mode.String() != "40000" {
+		t.Errorf("bad directory mode %v", e.Mode)
+	}
+
+	// old tools wrote zero-padded modes and didn't always sort, and such
+	// trees have to keep their ids
+	odd := []byte("100644 z\x00" + string(blob) + "040000 a\x00" + string(ObjectId(sub)))
+	parsed, err = parseTree(odd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed.Raw(), odd) {
+		t.Errorf("non-canonical tree didn't round-trip:\n%q", parsed.Raw())
+	}
+	if e := parsed.Entry(1); e.Mode != ModeDir {
+		t.Errorf("zero-padded mode parsed as %v", e.Mode)
+	}
+	parsed.Add("b", ModeFile, blob)
+	if want := "40000 a\x00" + string(ObjectId(sub)) + "100644 b\x00" + string(blob) + "100644 z\x00" + string(blob); string(parsed.Raw()) != want {
+		t.Errorf("modified tree isn't canonical:\n%q", parsed.Raw())
+	}
+}
+
+func TestCommitRoundTrip(t *testing.T) {
+	raw := "tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n" +
+		"parent 55109e9f6f3c0456cc8e52f990adea2a90f9b75d\n" +
+		"author A U Thor <a@x.com> 1234567890 -0000\n" +
+		"committer C O Mitter <c@x.com> 1234567999 +0530\n" +
+		"encoding ISO-8859-1\n" +
+		"x-custom some value\n" +
+		"gpgsig -----BEGIN PGP SIGNATURE-----\n \n iQEzBAABCAAdFiEE\n -----END PGP SIGNATURE-----\n" +
+		"\n" +
+		"Subject\n\nBody\n"
+	c, err := parseCommit([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := ObjectId(c).String(); id != "e2c0a7ebe73b043f3997ab59d79dcaaa51d6169c" {
+		t.Errorf("got id %s", id)
+	}
+	if c.Tree().String() != "4b825dc642cb6eb9a060e54bf8d69288fbee4904" || len(c.Parents()) != 1 {
+		t.Errorf("bad tree or parents")
+	}
+	committer := c.Committer()
+	if _, offset := committer.When.Zone(); committer.Name != "C O Mitter" || committer.When.Unix() != 1234567999 || offset != 330*60 {
+		t.Errorf("bad committer %v", committer)
+	}
+	if c.Encoding() != "ISO-8859-1" {
+		t.Errorf("got encoding %q", c.Encoding())
+	}
+	extra := c.ExtraHeaders()
+	if len(extra) != 3 || extra[1].Key != "x-custom" || extra[2].Key != "gpgsig" {
+		t.Fatalf("bad extra headers %v", extra)
+	}
+	if extra[2].Value != "-----BEGIN PGP SIGNATURE-----\n\niQEzBAABCAAdFiEE\n-----END PGP SIGNATURE-----" {
+		t.Errorf("bad gpgsig %q", extra[2].Value)
+	}
+	if c.Message() != "Subject\n\nBody\n" {
+		t.Errorf("got message %q", c.Message())
+	}
+
+	built := NewCommit(c.Author(), committer, c.Tree(), c.Parents(), c.Message(), extra...)
+	if !strings.HasSuffix(string(built.Raw()), raw[strings.Index(raw, "\ncommitter"):]) {
+		t.Errorf("NewCommit wrote\n%s", built.Raw())
+	}
+}
+
+func TestOpenBlob(t *testing.T) {
+	r, err := InitRepo(filepath.Join(t.TempDir(), "repo"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	blob := NewBlob(content)
+	id := ObjectId(blob)
+	// write the loose object by hand
+	path := loosePath(r, id)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	z := zlib.NewWriter(&b)
+	z.Write(ObjectFull(blob))
+	z.Close()
+	if err := ioutil.WriteFile(path, b.Bytes(), 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	if !r.Has(id) || r.Has(IdFromString("0123456789012345678901234567890123456789")) {
+		t.Errorf("Has is wrong")
+	}
+	objType, size, err := r.Stat(id)
+	if err != nil || objType != BlobObject || size != int64(len(content)) {
+		t.Errorf("Stat = %v, %d, %v", objType, size, err)
+	}
+
+	rc, size, err := r.OpenBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(content)) || !bytes.Equal(got, content) {
+		t.Errorf("got %d bytes (size %d), wanted %d", len(got), size, len(content))
+	}
+}
+
+func TestSave(t *testing.T) {
+	r, err := InitRepo(filepath.Join(t.TempDir(), "repo"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := NewBlob([]byte("saved\n"))
+	id, err := r.Save(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != ObjectId(blob) {
+		t.Errorf("Save returned %s, wanted %s", id, ObjectId(blob))
+	}
+	obj, err := r.GetObject(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(obj.Raw(), blob.Raw()) {
+		t.Errorf("read back %q", obj.Raw())
+	}
+	// saving again leaves the object alone
+	info, err := os.Stat(loosePath(r, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := r.Save(blob); err != nil || id != ObjectId(blob) {
+		t.Errorf("second Save = %s, %v", id, err)
+	}
+	if again, err := os.Stat(loosePath(r, id)); err != nil || !again.ModTime().Equal(info.ModTime()) || again.Mode().Perm() != 0444 {
+		t.Errorf("object was rewritten or has mode %v", info.Mode())
+	}
+	files, err := ioutil.ReadDir(filepath.Dir(loosePath(r, id)))
+	if err != nil || len(files) != 1 {
+		t.Errorf("temporary files were left behind: %v", err)
+	}
+}
+
+func TestDeltaReader(t *testing.T) {
+	base := []byte("the quick brown fox jumps over the lazy dog")
+	patch := []byte{
+		byte(len(base)), 20,
+		0x91, 4, 5, // copy "quick" from offset 4
+		4, ' ', 'r', 'e', 'd',
+		0x91, 35, 8, // copy "lazy dog"
+		3, '!', '!', '!',
+	}
+	want, err := applyDelta(base, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, size, err := newDeltaReader(bytes.NewReader(base), int64(len(base)), bufio.NewReader(bytes.NewReader(patch)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(want)) || !bytes.Equal(got, want) {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+func TestDeltaCycle(t *testing.T) {
+	// two REF_DELTA entries, each the other's base
+	a, b := NewBlob([]byte("a\n")), NewBlob([]byte("b\n"))
+	var pack bytes.Buffer
+	hw := &hashWriter{w: &pack, h: sha1.New()}
+	hw.Write([]byte(packHeader))
+	hw.Write([]byte{0, 0, 0, 2})
+	var entries []indexEntry
+	for _, e := range []struct{ target, base *Blob }{{a, b}, {b, a}} {
+		entries = append(entries, indexEntry{id: ObjectId(e.target), offset: uint64(pack.Len())})
+		delta := createDelta(e.base.Raw(), e.target.Raw(), 0)
+		hw.Write(packEntryHeader(_OBJ_REF_DELTA, uint64(len(delta))))
+		hw.Write([]byte(string(ObjectId(e.base))))
+		writeCompressed(hw, delta)
+	}
+	sum := hw.h.Sum(nil)
+	pack.Write(sum)
+	var idx bytes.Buffer
+	sort.Sort(indexOrder(entries))
+	if err := writeIndex(&idx, entries, sum); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := InitRepo(filepath.Join(t.TempDir(), "repo"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(r.path, "objects", "pack", "pack-cycle")
+	if err := ioutil.WriteFile(base+".pack", pack.Bytes(), 0444); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(base+".idx", idx.Bytes(), 0444); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetObject(ObjectId(a)); !errors.Is(err, ErrCorruptObject) {
+		t.Errorf("GetObject: got %v, wanted ErrCorruptObject", err)
+	}
+	if _, _, err := r.OpenBlob(ObjectId(a)); !errors.Is(err, ErrCorruptObject) {
+		t.Errorf("OpenBlob: got %v, wanted ErrCorruptObject", err)
+	}
+	if report, err := r.Fsck(); err != nil || len(report.Corrupt) != 2 {
+		t.Errorf("Fsck = %+v, %v", report, err)
+	}
+}
+
+// packRepo creates a repository whose only pack is testdata/test.pack with
+// the given index.
+func packRepo(t *testing.T, idx string) *Repo {
+	r, err := InitRepo(filepath.Join(t.TempDir(), "repo"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packDir := filepath.Join(r.path, "objects", "pack")
+	if err := os.MkdirAll(packDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for src, dst := range map[string]string{"test.pack": "pack-test.pack", idx: "pack-test.idx"} {
+		b, err := ioutil.ReadFile(filepath.Join("testdata", src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(packDir, dst), b, 0444); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+// objects in testdata/test.pack
+var packObjects = []struct {
+	id      string
+	objType ObjectType
+	size    int64
+}{
+	{"f4ec1ee053d64434cd25a946e71c21f71143aac4", CommitObject, 166},
+	{"e4a34a93cd4e7b8eaa9363ab0a89bd639d62f10c", TagObject, 107},
+	{"73cb1a08586bba3062ca4355acb0f1ba372b5d00", CommitObject, 118},
+	{"a01a670bdabc9f084e9048abcc0246965b490f0f", TreeObject, 73},
+	{"793564b20a648a3951492aef43c7d33f2b7b5ac2", TreeObject, 73},
+	{"ce013625030ba8dba906f756967f9e9ca394464a", BlobObject, 6},
+	{"006fb275eb45cd00e694f0b030938f9258ecd172", BlobObject, 1132},
+	{"e9f1816de795d8e46914856d53c0f1de4291ce89", BlobObject, 1092}, // delta
+}
+
+func TestPackIndexVersions(t *testing.T) {
+	for _, idx := range []string{"v1.idx", "v2.idx", "large.idx"} {
+		r := packRepo(t, idx)
+		for _, want := range packObjects {
+			id := IdFromString(want.id)
+			obj, err := r.GetObject(id)
+			if err != nil {
+				t.Errorf("%s: %s: %v", idx, want.id, err)
+				continue
+			}
+			if ObjectId(obj) != id {
+				t.Errorf("%s: %s has id %s", idx, want.id, ObjectId(obj))
+			}
+			objType, size, err := r.Stat(id)
+			if err != nil || objType != want.objType || size != want.size {
+				t.Errorf("%s: Stat(%s) = %v, %d, %v", idx, want.id, objType, size, err)
+			}
+			if objType != BlobObject {
+				continue
+			}
+			rc, _, err := r.OpenBlob(id)
+			if err != nil {
+				t.Errorf("%s: OpenBlob(%s): %v", idx, want.id, err)
+				continue
+			}
+			content, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil || !bytes.Equal(content, obj.Raw()) {
+				t.Errorf("%s: OpenBlob(%s) read %d bytes, %v", idx, want.id, len(content), err)
+			}
+		}
+	}
+}
+
+// writePack writes the pack from pw into r's pack directory.
+func writePack(t *testing.T, r *Repo, pw *PackWriter) Id {
+	var pack, idx bytes.Buffer
+	sum, err := pw.Write(&pack, &idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(r.path, "objects", "pack", "pack-"+sum.String())
+	if err := os.MkdirAll(filepath.Dir(base), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(base+".pack", pack.Bytes(), 0444); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(base+".idx", idx.Bytes(), 0444); err != nil {
+		t.Fatal(err)
+	}
+	return sum
+}
+
+func TestPackWriter(t *testing.T) {
+	src := packRepo(t, "v2.idx")
+	pw := NewPackWriter()
+	for _, o := range packObjects {
+		if err := pw.AddId(src, IdFromString(o.id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	extra := NewBlob([]byte("not in the source pack\n"))
+	pw.Add(extra)
+	pw.Add(extra)
+	if pw.Len() != len(packObjects)+1 {
+		t.Errorf("got %d objects, wanted %d", pw.Len(), len(packObjects)+1)
+	}
+
+	dst, err := InitRepo(filepath.Join(t.TempDir(), "dst"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePack(t, dst, pw)
+	for _, o := range packObjects {
+		id := IdFromString(o.id)
+		obj, err := dst.GetObject(id)
+		if err != nil {
+			t.Errorf("%s: %v", o.id, err)
+		} else if ObjectId(obj) != id {
+			t.Errorf("%s has id %s", o.id, ObjectId(obj))
+		}
+	}
+	if obj, err := dst.GetObject(ObjectId(extra)); err != nil || !bytes.Equal(obj.Raw(), extra.Raw()) {
+		t.Errorf("extra blob: %v", err)
+	}
+
+	// the zero PackWriter works too
+	var zero PackWriter
+	zero.Add(extra)
+	if err := zero.AddId(src, IdFromString(packObjects[0].id)); err != nil {
+		t.Fatal(err)
+	}
+	writePack(t, dst, &zero)
+	if zero.Len() != 2 {
+		t.Errorf("zero PackWriter has %d objects", zero.Len())
+	}
+}
+
+func TestCreateDelta(t *testing.T) {
+	base := bytes.Repeat([]byte("line of text number something\n"), 5000)
+	edits := [][]byte{
+		append(append([]byte("new first line\n"), base[:70000]...), base[80000:]...),
+		append(append([]byte{}, base...), "appended\n"...),
+		base[1000:2000],
+		[]byte("nothing in common"),
+		{},
+	}
+	for i, target := range edits {
+		delta := createDelta(base, target, 0)
+		got, err := applyDelta(base, delta)
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+		} else if !bytes.Equal(got, target) {
+			t.Errorf("%d: delta doesn't reproduce target", i)
+		}
+	}
+	if createDelta(base, edits[3], 5) != nil {
+		t.Errorf("createDelta ignored maxSize")
+	}
+}
+
+func TestPackWriterDeltas(t *testing.T) {
+	src, err := InitRepo(filepath.Join(t.TempDir(), "src"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// versions of a file that each add a line
+	var blobs []*Blob
+	content := []byte{}
+	for i := 0; i < 20; i++ {
+		content = append(content, "another line of the file, number "+strconv.Itoa(i)+"\n"...)
+		blobs = append(blobs, NewBlob(append([]byte(nil), content...)))
+	}
+
+	plain := NewPackWriter()
+	plain.Window = 0
+	deltified := NewPackWriter()
+	deltified.Depth = 3
+	for _, b := range blobs {
+		plain.Add(b)
+		deltified.Add(b)
+	}
+	var plainPack, deltaPack, idx bytes.Buffer
+	if _, err := plain.Write(&plainPack, &idx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deltified.Write(&deltaPack, &idx); err != nil {
+		t.Fatal(err)
+	}
+	if deltaPack.Len() >= plainPack.Len() {
+		t.Errorf("deltified pack is %d bytes, plain pack is %d", deltaPack.Len(), plainPack.Len())
+	}
+	for _, e := range deltified.entries {
+		if e.depth > 3 {
+			t.Errorf("%s has depth %d", e.id, e.depth)
+		}
+	}
+
+	writePack(t, src, deltified)
+	for _, b := range blobs {
+		obj, err := src.GetObject(ObjectId(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(obj.Raw(), b.Raw()) {
+			t.Errorf("%s didn't survive deltification", ObjectId(b))
+		}
+	}
+
+	// testdata/test.pack stores e9f18 as a delta against 006fb
+	reuse := NewPackWriter()
+	reuse.Window = 0
+	r := packRepo(t, "v2.idx")
+	for _, id := range []string{"006fb275eb45cd00e694f0b030938f9258ecd172", "e9f1816de795d8e46914856d53c0f1de4291ce89"} {
+		if err := reuse.AddId(r, IdFromString(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst, err := InitRepo(filepath.Join(t.TempDir(), "dst"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePack(t, dst, reuse)
+	if reuse.entries[1].base != reuse.entries[0] {
+		t.Errorf("delta wasn't reused")
+	}
+	if _, err := dst.GetObject(IdFromString("e9f1816de795d8e46914856d53c0f1de4291ce89")); err != nil {
+		t.Error(err)
+	}
+}
+
+// refDeltaPack builds a pack holding a REF_DELTA of target against base,
+// and base itself if includeBase is set.
+func refDeltaPack(base, target *Blob, includeBase bool) []byte {
+	var b bytes.Buffer
+	hw := &hashWriter{w: &b, h: sha1.New()}
+	count := 1
+	if includeBase {
+		count++
+	}
+	hw.Write([]byte(packHeader))
+	hw.Write([]byte{0, 0, 0, byte(count)})
+	delta := createDelta(base.Raw(), target.Raw(), 0)
+	hw.Write(packEntryHeader(_OBJ_REF_DELTA, uint64(len(delta))))
+	hw.Write([]byte(string(ObjectId(base))))
+	writeCompressed(hw, delta)
+	if includeBase {
+		hw.Write(packEntryHeader(_OBJ_BLOB, uint64(len(base.Raw()))))
+		writeCompressed(hw, base.Raw())
+	}
+	b.Write(hw.h.Sum(nil))
+	return b.Bytes()
+}
+
+func TestIndexPack(t *testing.T) {
+	r, err := InitRepo(filepath.Join(t.TempDir(), "repo"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack, err := ioutil.ReadFile("testdata/test.pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	stats, err := IndexPackProgress(bytes.NewReader(pack), r, func(PackStats) { calls++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Objects != 8 || stats.Received != 8 || stats.Deltas != 1 || stats.Resolved != 1 || calls != 9 {
+		t.Errorf("bad stats %+v after %d calls", stats, calls)
+	}
+	if stats.Bytes != int64(len(pack)) {
+		t.Errorf("read %d bytes, pack is %d", stats.Bytes, len(pack))
+	}
+	// the index should be exactly what git generated
+	base := filepath.Join(r.path, "objects", "pack", "pack-"+stats.Id.String())
+	idx, err := ioutil.ReadFile(base + ".idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile("testdata/v2.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(idx, want) {
+		t.Errorf("index differs from git's")
+	}
+	for _, o := range packObjects {
+		if _, err := r.GetObject(IdFromString(o.id)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// REF_DELTA whose base comes later in the pack
+	b1 := NewBlob(bytes.Repeat([]byte("base content\n"), 100))
+	b2 := NewBlob(append(bytes.Repeat([]byte("base content\n"), 100), "more\n"...))
+	if _, err := IndexPack(bytes.NewReader(refDeltaPack(b1, b2, true)), r); err != nil {
+		t.Fatal(err)
+	}
+	if obj, err := r.GetObject(ObjectId(b2)); err != nil || !bytes.Equal(obj.Raw(), b2.Raw()) {
+		t.Errorf("REF_DELTA object: %v", err)
+	}
+
+	bad := append([]byte(nil), pack...)
+	bad[len(bad)-1] ^= 1
+	if _, err := IndexPack(bytes.NewReader(bad), r); !errors.Is(err, ErrCorruptObject) {
+		t.Errorf("bad checksum: got %v", err)
+	}
+}
+
+func TestIndexThinPack(t *testing.T) {
+	r, err := InitRepo(filepath.Join(t.TempDir(), "repo"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1 := NewBlob(bytes.Repeat([]byte("base content\n"), 100))
+	b2 := NewBlob(append(bytes.Repeat([]byte("base content\n"), 100), "more\n"...))
+	thin := refDeltaPack(b1, b2, false)
+	if _, err := IndexPack(bytes.NewReader(thin), r); !errors.Is(err, ErrCorruptObject) {
+		t.Errorf("thin pack without its base: got %v", err)
+	}
+
+	pw := NewPackWriter()
+	pw.Add(b1)
+	writePack(t, r, pw)
+	stats, err := IndexPack(bytes.NewReader(thin), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Appended != 1 || stats.Resolved != 1 {
+		t.Errorf("bad stats %+v", stats)
+	}
+
+	// the completed pack should work without the pack holding the base
+	other, err := InitRepo(filepath.Join(t.TempDir(), "other"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(r.path, "objects", "pack", "pack-"+stats.Id.String())
+	pack, err := ioutil.ReadFile(base + ".pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IndexPack(bytes.NewReader(pack), other); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*Blob{b1, b2} {
+		if obj, err := other.GetObject(ObjectId(b)); err != nil || !bytes.Equal(obj.Raw(), b.Raw()) {
+			t.Errorf("%s: %v", ObjectId(b), err)
+		}
+	}
+
+	// a chain of REF_DELTAs, x against b1 and y against x, where x sorts
+	// before b1 and so is looked for first
+	var x *Blob
+	for i := 0; x == nil; i++ {
+		c := NewBlob(append(b1.Raw(), strconv.Itoa(i)+"\n"...))
+		if ObjectId(c) < ObjectId(b1) {
+			x = c
+		}
+	}
+	y := NewBlob(append(x.Raw(), "more\n"...))
+	var chain bytes.Buffer
+	hw := &hashWriter{w: &chain, h: sha1.New()}
+	hw.Write([]byte(packHeader))
+	hw.Write([]byte{0, 0, 0, 2})
+	for _, d := range []struct{ base, target *Blob }{{x, y}, {b1, x}} {
+		delta := createDelta(d.base.Raw(), d.target.Raw(), 0)
+		hw.Write(packEntryHeader(_OBJ_REF_DELTA, uint64(len(delta))))
+		hw.Write([]byte(string(ObjectId(d.base))))
+		writeCompressed(hw, delta)
+	}
+	chain.Write(hw.h.Sum(nil))
+	if stats, err = IndexPack(bytes.NewReader(chain.Bytes()), r); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Appended != 1 || stats.Resolved != 2 {
+		t.Errorf("chained thin pack: bad stats %+v", stats)
+	}
+	for _, b := range []*Blob{x, y} {
+		if obj, err := r.GetObject(ObjectId(b)); err != nil || !bytes.Equal(obj.Raw(), b.Raw()) {
+			t.Errorf("%s: %v", ObjectId(b), err)
+		}
+	}
+
+	// now x is in the repository too, but it's also a delta in the pack,
+	// so only b1 should be appended
+	if stats, err = IndexPack(bytes.NewReader(chain.Bytes()), r); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Appended != 1 || stats.Resolved != 2 {
+		t.Errorf("chained thin pack with a local base: bad stats %+v", stats)
+	}
+	report, err := VerifyPack(filepath.Join(r.path, "objects", "pack", "pack-"+stats.Id.String()+".idx"))
+	if err != nil || len(report.Objects) != 3 {
+		t.Errorf("VerifyPack = %+v, %v", report, err)
+	}
+}
+
+func TestVerifyPack(t *testing.T) {
+	for _, idx := range []string{"v1.idx", "v2.idx", "large.idx"} {
+		r := packRepo(t, idx)
+		path := filepath.Join(r.path, "objects", "pack", "pack-test.idx")
+		report, err := VerifyPack(path)
+		if err != nil {
+			t.Fatalf("%s: %v", idx, err)
+		}
+		if report.Id.String() != "5b18d92cfa20e16b969914e98f4415bcc0271f71" || len(report.Objects) != len(packObjects) {
+			t.Fatalf("%s: bad report %+v", idx, report)
+		}
+		// same order and numbers as git verify-pack -v
+		delta := report.Objects[7]
+		if delta.Id.String() != "e9f1816de795d8e46914856d53c0f1de4291ce89" || delta.Type != BlobObject ||
+			delta.Size != 7 || delta.PackedSize != 18 || delta.Offset != 1060 || delta.Depth != 1 ||
+			delta.Base.String() != "006fb275eb45cd00e694f0b030938f9258ecd172" {
+			t.Errorf("%s: bad delta entry %+v", idx, delta)
+		}
+	}
+
+	// flip a bit in the middle of the pack
+	r := packRepo(t, "v2.idx")
+	path := filepath.Join(r.path, "objects", "pack", "pack-test.pack")
+	pack, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack[600] ^= 1
+	os.Chmod(path, 0644)
+	if err := ioutil.WriteFile(path, pack, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyPack(path); !errors.Is(err, ErrCorruptObject) {
+		t.Errorf("corrupt pack: got %v", err)
+	}
+}
+
+// loosePath returns where the loose object id is on disk.
+func loosePath(r *Repo, id Id) string {
+	return filepath.Join(r.path, filepath.FromSlash(r.objects.(*FileStore).loosePath(id)))
+}
+
+// writeLoose writes a loose object by hand, so it can be malformed.
+func writeLoose(t *testing.T, r *Repo, objType string, content []byte) Id {
+	full := append([]byte(objType+" "+strconv.Itoa(len(content))+"\x00"), content...)
+	sum := sha1.Sum(full)
+	id := Id(string(sum[:]))
+	path := loosePath(r, id)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	z := zlib.NewWriter(&b)
+	z.Write(full)
+	z.Close()
+	if err := ioutil.WriteFile(path, b.Bytes(), 0444); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestFsck(t *testing.T) {
+	r := packRepo(t, "v2.idx")
+	report, err := r.Fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Checked != len(packObjects) || len(report.Unreachable) != len(packObjects) {
+		t.Fatalf("without refs: %+v", report)
+	}
+	// only the tag isn't pointed to by anything
+	tag := IdFromString("e4a34a93cd4e7b8eaa9363ab0a89bd639d62f10c")
+	if len(report.Dangling) != 1 || report.Dangling[0].Id != tag || report.Dangling[0].Type != TagObject {
+		t.Errorf("dangling = %+v", report.Dangling)
+	}
+
+	write := func(name, content string) {
+		path := filepath.Join(r.path, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("refs/tags/v1", tag.String()+"\n")
+	if report, err = r.Fsck(); err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || len(report.Unreachable) != 0 {
+		t.Errorf("with refs: %+v", report)
+	}
+
+	blob := ObjectId(NewBlob([]byte("hello\n")))
+	unsorted := writeLoose(t, r, "tree", []byte("100644 b\x00"+string(blob)+"100644 a\x00"+string(blob)))
+	missingTree := IdFromString("1111111111111111111111111111111111111111")
+	commit := writeLoose(t, r, "commit", []byte("tree "+missingTree.String()+"\nauthor T <t@x> 1 +0000\ncommitter T <t@x> 1 +0000\n\nbroken\n"))
+	badIdent := writeLoose(t, r, "commit", []byte("tree "+missingTree.String()+"\nauthor T <t@x> yesterday\ncommitter T <t@x> 1 +0000\n\n"))
+	write("refs/heads/broken", commit.String()+"\n")
+	gone := IdFromString("2222222222222222222222222222222222222222")
+	write("logs/refs/heads/gone", strings.Repeat("0", 40)+" "+gone.String()+" T <t@x> 1 +0000\tcreated\n")
+	write("refs/heads/garbage", "not an id\n")
+	write("refs/remotes/origin/HEAD", "ref: refs/remotes/origin/renamed\n")
+
+	if report, err = r.Fsck(); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Corrupt) != 3 {
+		t.Fatalf("corrupt = %+v", report.Corrupt)
+	}
+	// the broken ref sorts first, since it has no id
+	if c := report.Corrupt[0]; c.Id != "" || c.Ref != "refs/heads/garbage" || c.Err == nil {
+		t.Errorf("broken ref: %+v", c)
+	}
+	for _, c := range report.Corrupt[1:] {
+		if (c.Id != unsorted && c.Id != badIdent) || !errors.Is(c.Err, ErrCorruptObject) {
+			t.Errorf("corrupt %s: %v", c.Id, c.Err)
+		}
+	}
+	found := map[string]bool{}
+	for _, m := range report.Missing {
+		switch {
+		case m.Id == missingTree && m.From == commit && m.Type == TreeObject:
+			found["tree"] = true
+		case m.Id == gone && m.Ref == "logs/refs/heads/gone":
+			found["reflog"] = true
+		default:
+			t.Errorf("unexpected missing %+v", m)
+		}
+	}
+	if len(found) != 2 {
+		t.Errorf("missing = %+v", report.Missing)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	blob := NewBlob([]byte("in memory\n"))
+	tree := NewTree(1)
+	tree.Add("file", ModeFile, ObjectId(blob))
+	for _, obj := range []Object{blob, tree, blob} {
+		if id, err := s.Put(obj); err != nil || id != ObjectId(obj) {
+			t.Fatalf("Put = %s, %v", id, err)
+		}
+	}
+	if !s.Has(ObjectId(tree)) || s.Has(ObjectId(NewBlob(nil))) {
+		t.Errorf("Has is wrong")
+	}
+	if objType, size, err := s.Stat(ObjectId(blob)); err != nil || objType != BlobObject || size != 10 {
+		t.Errorf("Stat = %v, %d, %v", objType, size, err)
+	}
+	if _, err := s.Get(ObjectId(NewBlob(nil))); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Get of a missing object: %v", err)
+	}
+	n := 0
+	s.Iterate(func(id Id, objType ObjectType) error {
+		n++
+		return nil
+	})
+	if n != 2 {
+		t.Errorf("Iterate visited %d objects", n)
+	}
+
+	// a pack goes straight into the store
+	r := NewRepoWithStore(NewMemoryFS(), NewMemoryStore())
+	f, err := os.Open(filepath.Join("testdata", "test.pack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := IndexPack(f, r); err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range packObjects {
+		objType, size, err := r.Stat(IdFromString(o.id))
+		if err != nil || objType != o.objType || size != o.size {
+			t.Errorf("%s: Stat = %v, %d, %v", o.id, objType, size, err)
+		}
+	}
+	rc, size, err := r.OpenBlob(IdFromString("e9f1816de795d8e46914856d53c0f1de4291ce89"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if b, err := ioutil.ReadAll(rc); err != nil || int64(len(b)) != size || size != 1092 {
+		t.Errorf("OpenBlob read %d bytes of %d: %v", len(b), size, err)
+	}
+}
+
+func TestMemoryFS(t *testing.T) {
+	m := NewMemoryFS()
+	if err := m.MkdirAll("a/b", 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"top", "a/one", "a/b/two"} {
+		if err := writeFile(m, name, []byte(name), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := m.TempFile("a", "tmp_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("temporary"))
+	f.Close()
+	if err := m.Rename(f.Name(), "a/b/three"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(m, "top", "a/one", "a/b/two", "a/b/three"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Open("../top"); err == nil {
+		t.Errorf("opened a name outside the file system")
+	}
+
+	// entries removed while a directory is being read
+	d, err := m.Open("a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := d.(fs.ReadDirFile).ReadDir(-1); err != nil || len(entries) != 2 {
+		t.Fatalf("ReadDir = %v, %v", entries, err)
+	}
+	if err := m.Remove("a/b/three"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := d.(fs.ReadDirFile).ReadDir(1); err != io.EOF {
+		t.Errorf("ReadDir after a removal = %v, %v", entries, err)
+	}
+	d.Close()
+
+	// a whole repository without touching the disk
+	r, err := InitRepoFS(m, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack, err := os.Open(filepath.Join("testdata", "test.pack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pack.Close()
+	if _, err := IndexPack(pack, r); err != nil {
+		t.Fatal(err)
+	}
+	commit := NewCommitSimple(Signature{"T", "t@x", time.Unix(1, 0).UTC()}, IdFromString("a01a670bdabc9f084e9048abcc0246965b490f0f"), IdFromString("f4ec1ee053d64434cd25a946e71c21f71143aac4"))
+	id, err := r.Save(commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.writeRefs(map[string]Id{"refs/heads/master": id}); err != nil {
+		t.Fatal(err)
+	}
+	if head, err := r.Head(); err != nil || head != id {
+		t.Errorf("Head = %s, %v", head, err)
+	}
+	report, err := r.Fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Checked != len(packObjects)+1 || len(report.Dangling) != 1 {
+		t.Errorf("fsck: %+v", report)
+	}
+}
+
+func TestAlternates(t *testing.T) {
+	shared := packRepo(t, "v2.idx")
+	r, err := InitRepo(filepath.Join(t.TempDir(), "repo"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(filepath.Join(r.path, "objects"), filepath.Join(shared.path, "objects"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the shared repository lists r in turn, which mustn't loop forever
+	for dir, content := range map[string]string{
+		r.path:      "# shared objects\n" + rel + "\n/does/not/exist\n",
+		shared.path: filepath.Join(r.path, "objects") + "\n",
+	} {
+		info := filepath.Join(dir, "objects", "info")
+		if err := os.MkdirAll(info, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(info, "alternates"), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, o := range packObjects {
+		id := IdFromString(o.id)
+		if _, err := r.GetObject(id); err != nil {
+			t.Errorf("GetObject(%s): %v", o.id, err)
+		}
+		if objType, size, err := r.Stat(id); err != nil || objType != o.objType || size != o.size {
+			t.Errorf("Stat(%s) = %v, %d, %v", o.id, objType, size, err)
+		}
+	}
+	rc, _, err := r.OpenBlob(IdFromString("e9f1816de795d8e46914856d53c0f1de4291ce89"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	n := 0
+	if err := r.Objects().Iterate(func(Id, ObjectType) error { n++; return nil }); err != nil || n != len(packObjects) {
+		t.Errorf("Iterate visited %d objects: %v", n, err)
+	}
+
+	// new objects go in r, and aren't written if an alternate has them
+	blob := NewBlob([]byte("hello\n"))
+	if _, err := r.Save(blob); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(loosePath(r, ObjectId(blob))); !os.IsNotExist(err) {
+		t.Errorf("object in an alternate was written again")
+	}
+	report, err := r.Fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || len(report.Unreachable) != 0 {
+		t.Errorf("fsck: %+v", report)
+	}
+}
+
+func TestOpenRepo(t *testing.T) {
+	for _, name := range []string{"GIT_DIR", "GIT_WORK_TREE", "GIT_OBJECT_DIRECTORY", "GIT_ALTERNATE_OBJECT_DIRECTORIES"} {
+		t.Setenv(name, "")
+	}
+	write := func(name, content string) {
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	open := func(path, gitDir, workDir string) *Repo {
+		t.Helper()
+		r, err := OpenRepo(path)
+		if err != nil {
+			t.Fatalf("OpenRepo(%s): %v", path, err)
+		}
+		if r.path != gitDir || r.WorkDir() != workDir || r.IsBare() != (workDir == "") {
+			t.Errorf("OpenRepo(%s) = %s, %q, bare %v", path, r.path, r.WorkDir(), r.IsBare())
+		}
+		return r
+	}
+
+	// discovery from inside a working tree
+	work := t.TempDir()
+	main, err := InitRepo(work, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := writeLoose(t, main, "blob", []byte("hello\n"))
+	write(filepath.Join(work, "a", "b", "file"), "")
+	open(filepath.Join(work, "a", "b"), filepath.Join(work, ".git"), work)
+	open(filepath.Join(work, ".git", "refs"), filepath.Join(work, ".git"), work)
+
+	// a linked worktree shares refs and objects but has its own HEAD
+	linked := t.TempDir()
+	wtDir := filepath.Join(work, ".git", "worktrees", "wt")
+	write(filepath.Join(linked, ".git"), "gitdir: "+wtDir+"\n")
+	write(filepath.Join(wtDir, "HEAD"), "ref: refs/heads/wt\n")
+	write(filepath.Join(wtDir, "commondir"), "../..\n")
+	write(filepath.Join(work, ".git", "refs", "heads", "wt"), blob.String()+"\n")
+	r := open(linked, wtDir, linked)
+	if head, err := r.Head(); err != nil || head != blob {
+		t.Errorf("worktree Head() = %s, %v", head, err)
+	}
+	if _, err := r.GetObject(blob); err != nil {
+		t.Errorf("worktree GetObject: %v", err)
+	}
+
+	// core.bare overrides the name of the directory
+	bareDir := filepath.Join(t.TempDir(), "bare.git")
+	if _, err := InitRepo(bareDir, true); err != nil {
+		t.Fatal(err)
+	}
+	open(bareDir, bareDir, "")
+	write(filepath.Join(bareDir, "config"), "[core]\n\tbare = true ; comment\n")
+	open(filepath.Join(work, ".git"), filepath.Join(work, ".git"), work)
+	write(filepath.Join(work, ".git", "config"), "[core]\n\tbare\n")
+	open(work, filepath.Join(work, ".git"), "")
+
+	if _, err := OpenRepo(t.TempDir()); !errors.Is(err, ErrNotARepo) {
+		t.Errorf("OpenRepo outside a repository: %v", err)
+	}
+	// a config that can't be parsed doesn't stop a repository from opening;
+	// whether it's bare is guessed from its name
+	write(filepath.Join(bareDir, "config"), "[core\n")
+	if r, err := NewRepo(bareDir); err != nil || !r.IsBare() {
+		t.Errorf("NewRepo with a bad config: %v", err)
+	}
+	open(bareDir, bareDir, "")
+	write(filepath.Join(bareDir, "config"), "[core]\n\tbare = true\n")
+
+	// the environment can name the directories instead
+	t.Setenv("GIT_DIR", bareDir)
+	t.Setenv("GIT_WORK_TREE", linked)
+	open(work, bareDir, linked)
+	t.Setenv("GIT_DIR", "")
+	t.Setenv("GIT_WORK_TREE", "")
+	shared := packRepo(t, "v2.idx")
+	id := IdFromString(packObjects[0].id)
+	t.Setenv("GIT_OBJECT_DIRECTORY", filepath.Join(shared.path, "objects"))
+	if r, err := OpenRepo(bareDir); err != nil {
+		t.Fatal(err)
+	} else if _, err := r.GetObject(id); err != nil {
+		t.Errorf("GIT_OBJECT_DIRECTORY: %v", err)
+	}
+	t.Setenv("GIT_OBJECT_DIRECTORY", "")
+	t.Setenv("GIT_ALTERNATE_OBJECT_DIRECTORIES", string(filepath.ListSeparator)+filepath.Join(shared.path, "objects"))
+	if r, err := OpenRepo(bareDir); err != nil {
+		t.Fatal(err)
+	} else if _, err := r.GetObject(id); err != nil {
+		t.Errorf("GIT_ALTERNATE_OBJECT_DIRECTORIES: %v", err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	c, err := parseConfig(`# comment
+[Core]
+	Bare = false
+	name = "quoted ; value"   # trailing
+[remote "Origin"]
+	url = one \
+two
+	fetch = a
+	fetch = b
+[branch.main]
+	rebase
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"core.bare":           "false",
+		"core.name":           "quoted ; value",
+		"remote.Origin.url":   "one two",
+		"remote.Origin.fetch": "b",
+		"branch.main.rebase":  "true",
+	} {
+		if v, ok := c.get(key); !ok || v != want {
+			t.Errorf("%s = %q, %v; want %q", key, v, ok, want)
+		}
+	}
+	if len(c["remote.Origin.fetch"]) != 2 {
+		t.Errorf("fetch = %q", c["remote.Origin.fetch"])
+	}
+	if _, err := parseConfig("[core\nbare\n"); err == nil {
+		t.Errorf("bad section header parsed")
+	}
+}
+
+func TestInitRepo(t *testing.T) {
+	layout := func(dir string) []string {
+		var names []string
+		err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(dir, name)
+			names = append(names, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+	want := []string{".", "HEAD", "branches", "config", "description", "hooks", "info", "info/exclude",
+		"objects", "objects/info", "objects/pack", "refs", "refs/heads", "refs/tags"}
+
+	work := t.TempDir()
+	r, err := InitRepo(work, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitDir := filepath.Join(work, ".git")
+	if got := layout(gitDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("layout = %q, want %q", got, want)
+	}
+	if r.path != gitDir || r.IsBare() || r.WorkDir() != work {
+		t.Errorf("InitRepo = %s, %q, bare %v", r.path, r.WorkDir(), r.IsBare())
+	}
+	if info, err := os.Stat(filepath.Join(gitDir, "refs", "heads")); err != nil || info.Mode().Perm()&0700 != 0700 {
+		t.Errorf("refs/heads: %v, %v", info.Mode(), err)
+	}
+	for name, content := range map[string]string{
+		"HEAD":   "ref: refs/heads/master\n",
+		"config": "[core]\n\trepositoryformatversion = 0\n\tfilemode = true\n\tbare = false\n\tlogallrefupdates = true\n",
+	} {
+		if got, err := ioutil.ReadFile(filepath.Join(gitDir, name)); err != nil || string(got) != content {
+			t.Errorf("%s = %q, %v", name, got, err)
+		}
+	}
+
+	// a bare repository with more options
+	template := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(template, "hooks"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(template, "hooks", "update"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	bareDir := filepath.Join(t.TempDir(), "bare.git")
+	r, err = InitRepoWithOptions(bareDir, InitOptions{Bare: true, InitialBranch: "main", Shared: "group", TemplateDir: template})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.IsBare() || r.WorkDir() != "" {
+		t.Errorf("bare repository has working tree %q", r.WorkDir())
+	}
+	c, err := readConfig(r.fs, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.get("core.sharedrepository"); v != "1" {
+		t.Errorf("core.sharedrepository = %q", v)
+	}
+	if head, err := ioutil.ReadFile(filepath.Join(bareDir, "HEAD")); err != nil || string(head) != "ref: refs/heads/main\n" {
+		t.Errorf("HEAD = %q, %v", head, err)
+	}
+	if _, err := os.Stat(filepath.Join(bareDir, "description")); !os.IsNotExist(err) {
+		t.Errorf("default description written with a template: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(bareDir, "hooks", "update")); err != nil || info.Mode().Perm()&0070 != 0070 {
+		t.Errorf("hooks/update: %v, %v", info.Mode(), err)
+	}
+	if info, err := os.Stat(filepath.Join(bareDir, "objects")); err != nil || info.Mode()&fs.ModeSetgid == 0 || info.Mode().Perm()&0070 != 0070 {
+		t.Errorf("objects: %v, %v", info.Mode(), err)
+	}
+
+	for _, opts := range []InitOptions{
+		{InitialBranch: "bad..name"},
+		{InitialBranch: "HEAD"},
+		{ObjectFormat: "sha256"},
+		{Shared: "0066"},
+	} {
+		if _, err := InitRepoWithOptions(t.TempDir(), opts); err == nil {
+			t.Errorf("InitRepoWithOptions(%+v) succeeded", opts)
+		}
+	}
+}
+
+func TestCaches(t *testing.T) {
+	r := packRepo(t, "v2.idx")
+	store := r.Objects().(*FileStore)
+	delta := IdFromString("e9f1816de795d8e46914856d53c0f1de4291ce89")
+	for i := 0; i < 2; i++ {
+		if obj, err := r.GetObject(delta); err != nil || ObjectId(obj) != delta {
+			t.Fatalf("GetObject(%s): %v", delta, err)
+		}
+	}
+	if stats := store.DeltaCacheStats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 || stats.Size != 1132 {
+		t.Errorf("delta cache stats = %+v", stats)
+	}
+	store.SetDeltaCacheSize(1000)
+	if stats := store.DeltaCacheStats(); stats.Entries != 0 || stats.Evictions != 1 {
+		t.Errorf("delta cache stats after shrinking = %+v", stats)
+	}
+	if _, err := r.GetObject(delta); err != nil {
+		t.Fatal(err)
+	}
+	if stats := store.DeltaCacheStats(); stats.Entries != 0 {
+		t.Errorf("delta base larger than the cache was kept: %+v", stats)
+	}
+
+	r.SetObjectCacheSize(2)
+	for _, o := range packObjects[:3] {
+		if _, err := r.GetObject(IdFromString(o.id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, err := r.GetObject(IdFromString(packObjects[2].id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := r.GetObject(IdFromString(packObjects[2].id)); again != first {
+		t.Errorf("cached object wasn't reused")
+	}
+	if stats := r.ObjectCacheStats(); stats.Hits != 2 || stats.Misses != 3 || stats.Evictions != 1 || stats.Entries != 2 {
+		t.Errorf("object cache stats = %+v", stats)
+	}
+	r.SetObjectCacheSize(0)
+	if stats := r.ObjectCacheStats(); stats != (CacheStats{}) {
+		t.Errorf("object cache stats after turning it off = %+v", stats)
+	}
+}
+
+func TestConcurrentReads(t *testing.T) {
+	r := packRepo(t, "v2.idx")
+	loose := writeLoose(t, r, "blob", []byte("loose\n"))
+	refs := map[string]Id{}
+	for i, o := range packObjects {
+		refs["refs/heads/b"+strconv.Itoa(i)] = IdFromString(o.id)
+	}
+	if err := r.writeRefs(refs); err != nil {
+		t.Fatal(err)
+	}
+	r.SetObjectCacheSize(4)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				o := packObjects[(g+i)%len(packObjects)]
+				if _, err := r.GetObject(IdFromString(o.id)); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := r.GetObject(loose); err != nil {
+					errs <- err
+					return
+				}
+				got, err := r.Refs()
+				if err != nil {
+					errs <- err
+					return
+				}
+				// the result is the caller's to change
+				got["refs/heads/mine"] = loose
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	got, err := r.Refs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(refs) {
+		t.Errorf("Refs() = %d refs, want %d", len(got), len(refs))
+	}
+}
+
+func TestPackRescan(t *testing.T) {
+	r, err := InitRepo(filepath.Join(t.TempDir(), "repo"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := r.Objects().(*FileStore)
+	packDir := filepath.Join(r.path, "objects", "pack")
+	if err := os.Remove(packDir); err != nil {
+		t.Fatal(err)
+	}
+	id := IdFromString(packObjects[0].id)
+	if _, err := r.GetObject(id); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("GetObject without a pack directory: %v", err)
+	}
+
+	// a lookup that misses finds a pack that's appeared since
+	other := packRepo(t, "v2.idx")
+	if err := os.Rename(filepath.Join(other.path, "objects", "pack"), packDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetObject(id); err != nil {
+		t.Fatalf("GetObject after adding a pack: %v", err)
+	}
+
+	// but doesn't read an unchanged directory again right away
+	scanned := store.scanned
+	if _, err := r.GetObject(IdFromString("0000000000000000000000000000000000000001")); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("GetObject of a missing object: %v", err)
+	}
+	if !store.scanned.Equal(scanned) {
+		t.Errorf("pack directory was read again")
+	}
+
+	// and packs that have gone are dropped
+	for _, ext := range []string{".idx", ".pack"} {
+		if err := os.Remove(filepath.Join(packDir, "pack-test"+ext)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := r.Stat(IdFromString("0000000000000000000000000000000000000001")); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Stat of a missing object: %v", err)
+	}
+	if packs, err := store.findPacks(); err != nil || len(packs) != 0 {
+		t.Errorf("findPacks() = %d packs, %v", len(packs), err)
+	}
+}
+
+func TestForEachObject(t *testing.T) {
+	r := packRepo(t, "v2.idx")
+	// a loose copy of a packed object, and one that's only loose
+	writeLoose(t, r, "blob", []byte("hello\n"))
+	loose := writeLoose(t, r, "blob", []byte("loose\n"))
+
+	want := map[Id]ObjectType{loose: BlobObject}
+	for _, o := range packObjects {
+		want[IdFromString(o.id)] = o.objType
+	}
+	got := map[Id]ObjectType{}
+	err := r.ForEachObject(func(id Id, objType ObjectType) error {
+		if _, ok := got[id]; ok {
+			t.Errorf("%s visited twice", id)
+		}
+		got[id] = objType
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ForEachObject visited %v, want %v", got, want)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = r.ForEachObject(func(Id, ObjectType) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("ForEachObject didn't stop: %v after %d objects", err, n)
+	}
+}
+
+func TestResolvePrefix(t *testing.T) {
+	r := packRepo(t, "v2.idx")
+	packed := IdFromString("e9f1816de795d8e46914856d53c0f1de4291ce89")
+	for _, prefix := range []string{"e9f1", "E9F18", packed.String()} {
+		if id, err := r.ResolvePrefix(prefix); err != nil || id != packed {
+			t.Errorf("ResolvePrefix(%s) = %s, %v", prefix, id, err)
+		}
+	}
+	for _, prefix := range []string{"e9f", "e9g1", packed.String() + "0"} {
+		if _, err := r.ResolvePrefix(prefix); err == nil || errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("ResolvePrefix(%s): %v", prefix, err)
+		}
+	}
+	if _, err := r.ResolvePrefix("e9f0"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("ResolvePrefix of a missing object: %v", err)
+	}
+
+	// find a loose object that shares four digits with the packed one
+	var blob *Blob
+	for i := 0; blob == nil; i++ {
+		b := NewBlob([]byte(strconv.Itoa(i)))
+		if strings.HasPrefix(ObjectId(b).String(), "e9f1") {
+			blob = b
+		}
+	}
+	loose, err := r.Save(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.ResolvePrefix("e9f1")
+	var ambiguous *AmbiguousIdError
+	if !errors.As(err, &ambiguous) || !errors.Is(err, ErrAmbiguousId) {
+		t.Fatalf("ResolvePrefix of an ambiguous prefix: %v", err)
+	}
+	want := []Id{loose, packed}
+	if loose > packed {
+		want = []Id{packed, loose}
+	}
+	if !reflect.DeepEqual(ambiguous.Candidates, want) {
+		t.Errorf("candidates = %v, want %v", ambiguous.Candidates, want)
+	}
+
+	for _, id := range []Id{loose, packed} {
+		abbrev, err := r.Abbrev(id, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := r.ResolvePrefix(abbrev); err != nil || got != id || len(abbrev) < 5 {
+			t.Errorf("Abbrev(%s) = %s, which resolves to %s, %v", id, abbrev, got, err)
+		}
+		if _, err := r.ResolvePrefix(abbrev[:len(abbrev)-1]); !errors.Is(err, ErrAmbiguousId) {
+			t.Errorf("Abbrev(%s) = %s isn't the shortest: %v", id, abbrev, err)
+		}
+	}
+	if abbrev, err := r.Abbrev(IdFromString(packObjects[0].id), 7); err != nil || abbrev != packObjects[0].id[:7] {
+		t.Errorf("Abbrev = %s, %v", abbrev, err)
+	}
+	if _, err := r.Abbrev(IdFromString("zz"), 7); err == nil {
+		t.Errorf("Abbrev of a bad id succeeded")
+	}
+
+	m := NewRepoWithStore(NewMemoryFS(), NewMemoryStore())
+	if _, err := m.Save(blob); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := m.ResolvePrefix(loose.String()[:6]); err != nil || id != loose {
+		t.Errorf("ResolvePrefix in memory = %s, %v", id, err)
+	}
+}
+
+func TestResolveRevision(t *testing.T) {
+	fsys := NewMemoryFS()
+	r, err := InitRepoFS(fsys, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, content string) {
+		if err := fsys.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(fsys, name, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save := func(obj Object) Id {
+		id, err := r.Save(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	file := save(NewBlob([]byte("hello\n")))
+	sub := NewTree(1)
+	sub.Add("file", ModeFile, file)
+	tree := NewTree(2)
+	tree.Add("README", ModeFile, file)
+	tree.Add("dir", ModeDir, save(sub))
+	treeId := save(tree)
+	sig := Signature{"A U Thor", "a@x.com", time.Unix(1000, 0)}
+	c1 := save(NewCommit(sig, sig, treeId, nil, "one\n"))
+	c2 := save(NewCommit(sig, sig, treeId, []Id{c1}, "two\n"))
+	c3 := save(NewCommit(sig, sig, treeId, []Id{c2}, "three\n"))
+	side := save(NewCommit(sig, sig, treeId, []Id{c1}, "side\n"))
+	merge := save(NewCommit(sig, sig, treeId, []Id{c3, side}, "merge\n"))
+	c2Obj, _ := r.GetObject(c2)
+	tag := save(NewTag("v1", c2Obj, &sig, "v1\n"))
+
+	if err := r.writeRefs(map[string]Id{
+		"refs/heads/master":          merge,
+		"refs/heads/side":            side,
+		"refs/tags/v1":               tag,
+		"refs/remotes/origin/master": c2,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	write("packed-refs", "# pack-refs with: peeled\n"+c3.String()+" refs/heads/packed\n")
+	write("ORIG_HEAD", c1.String()+"\n")
+	write("refs/remotes/origin/HEAD", "ref: refs/remotes/origin/master\n")
+	logLine := func(old, new Id, when int, msg string) string {
+		return old.String() + " " + new.String() + " A U Thor <a@x.com> " + strconv.Itoa(when) + " +0000\t" + msg + "\n"
+	}
+	write("logs/refs/heads/master", logLine(zeroId, c1, 1000, "commit (initial): one")+
+		logLine(c1, c2, 2000, "commit: two")+
+		logLine(c2, merge, 3000, "merge"))
+	write("logs/HEAD", logLine(merge, side, 4000, "checkout: moving from master to side")+
+		logLine(side, merge, 5000, "checkout: moving from side to master"))
+	write("config", "[core]\n\tbare = true\n"+
+		"[remote \"origin\"]\n\tfetch = +refs/heads/*:refs/remotes/origin/*\n"+
+		"[branch \"master\"]\n\tremote = origin\n\tmerge = refs/heads/master\n"+
+		"[branch \"side\"]\n\tremote = .\n\tmerge = refs/heads/master\n")
+
+	tests := []struct {
+		expr string
+		want Id
+	}{
+		{c2.String(), c2},
+		{c2.String()[:7], c2},
+		{"HEAD", merge},
+		{"@", merge},
+		{"master", merge},
+		{"heads/master", merge},
+		{"refs/heads/side", side},
+		{"packed", c3},
+		{"ORIG_HEAD", c1},
+		{"v1", tag},
+		{"origin/master", c2},
+		{"origin", c2},
+		{"v1^{}", c2},
+		{"v1^{commit}", c2},
+		{"v1^{tag}", tag},
+		{"v1^{tree}", treeId},
+		{"master^{tree}", treeId},
+		{"HEAD^", c3},
+		{"HEAD^1", c3},
+		{"HEAD^2", side},
+		{"HEAD^0", merge},
+		{"HEAD~2", c2},
+		{"HEAD^2^", c1},
+		{"HEAD^2~0", side},
+		{"v1~1", c1},
+		{"HEAD:README", file},
+		{"HEAD:dir/file", file},
+		{"v1:./dir/", ObjectId(sub)},
+		{"master@{0}", merge},
+		{"master@{1}", c2},
+		{"@{2}", c1},
+		{"master@{1970-01-01 00:41:00 +0000}", c2},
+		{"master@{1.year.ago}", merge},
+		{"@{-1}", side},
+		{"@{u}", c2},
+		{"master@{upstream}", c2},
+		{"side@{U}", merge},
+		{"master@{u}~1", c1},
+	}
+	for _, tt := range tests {
+		if id, err := r.ResolveRevision(tt.expr); err != nil || id != tt.want {
+			t.Errorf("ResolveRevision(%s) = %s, %v, want %s", tt.expr, id, err, tt.want)
+		}
+	}
+
+	// refs are read afresh, so changes show up right away
+	write("refs/heads/master", c3.String()+"\n")
+	if id, err := r.ResolveRevision("master"); err != nil || id != c3 {
+		t.Errorf("ResolveRevision(master) after an update = %s, %v", id, err)
+	}
+	if id, err := r.Head(); err != nil || id != c3 {
+		t.Errorf("Head() after an update = %s, %v", id, err)
+	}
+	if err := fsys.Remove("refs/heads/side"); err != nil {
+		t.Fatal(err)
+	}
+	if refs, err := r.Refs(); err != nil || refs["refs/heads/side"] != "" || refs["refs/heads/packed"] != c3 {
+		t.Errorf("Refs() after a deletion = %v, %v", refs, err)
+	}
+	write("refs/heads/master", merge.String()+"\n")
+
+	for _, expr := range []string{"nope", "heads", "tags", "remotes", "HEAD^3", "HEAD~5", "HEAD^{blob}", "HEAD:missing", "HEAD:README/x", "master@{4}", "@{-3}", "origin/master@{u}", "HEAD^^2"} {
+		if _, err := r.ResolveRevision(expr); !errors.Is(err, ErrUnknownRevision) {
+			t.Errorf("ResolveRevision(%s): %v", expr, err)
+		}
+	}
+	for _, expr := range []string{"", ":README", "HEAD^{/fix}", "HEAD@{x", "master@{bogus}"} {
+		if _, err := r.ResolveRevision(expr); err == nil || errors.Is(err, ErrUnknownRevision) {
+			t.Errorf("ResolveRevision(%s): %v", expr, err)
+		}
+	}
+}
+
+func TestWriteRefs(t *testing.T) {
+	dir := t.TempDir()
+	r, err := InitRepo(filepath.Join(dir, "repo"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := ioutil.ReadFile(filepath.Join(r.path, "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := IdFromString(packObjects[0].id)
+	// names a malicious server might advertise
+	if err := r.writeRefs(map[string]Id{
+		"refs/heads/ok":   id,
+		"refs/../config":  id,
+		"refs/../../x":    id,
+		"refs/heads/a..b": id,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(r.path, "config")); err != nil || !bytes.Equal(got, config) {
+		t.Errorf("config was overwritten: %q, %v", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "x")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("wrote outside the repository: %v", err)
+	}
+	if refs, err := r.Refs(); err != nil || len(refs) != 1 || refs["refs/heads/ok"] != id {
+		t.Errorf("Refs = %v, %v", refs, err)
+	}
+}
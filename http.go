@@ -3,10 +3,9 @@ package git
 // This file implements HTTP (both "smart" and "dumb") transport for the
 // Git protocol.
 import (
-	"fmt"
+	"bytes"
 	"io"
 	"net/http"
-	"os"
 	"regexp"
 	"strings"
 )
@@ -43,7 +42,6 @@ var routes = []struct {
 }
 
 func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	r.Write(os.Stdout)
 	for _, route := range routes {
 		if route.pattern.MatchString(r.URL.Path) {
 			route.handler(h.Repo, w, r)
@@ -53,8 +51,6 @@ func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func uploadPack(repo *Repo, w http.ResponseWriter, r *http.Request) {
-	fmt.Println("copying request")
-	io.Copy(os.Stdout, r.Body)
 	//repo.negotiate(w, r.Body)
 }
 
@@ -73,10 +69,16 @@ func serveRefs(repo *Repo, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// build the advertisement first so we can still report an error
+	var refs bytes.Buffer
+	if err := repo.advertiseRefs(&refs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/x-"+service+"-advertisement")
 	writePacket(w, []byte("# service="+service))
 	flush(w)
-	repo.advertiseRefs(w)
+	refs.WriteTo(w)
 }
 
 func serveText(repo *Repo, w http.ResponseWriter, r *http.Request) {
@@ -111,7 +113,7 @@ func serveFile(repo *Repo, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	name := repo.file(r.URL.Path)
-	f, err := os.Open(name)
+	f, err := repo.fsFor(name).Open(name)
 	if err != nil {
 		http.NotFound(w, r)
 		return
@@ -0,0 +1,479 @@
+package git
+
+// This file implements reading a pack from a stream, like git index-pack.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// PackStats describes the progress of IndexPack.
+type PackStats struct {
+	Objects  int // objects in the pack, from its header
+	Received int // objects read so far
+	Deltas   int // deltas among the objects read
+	Resolved int // deltas resolved so far
+	Appended int // delta bases copied from the repository to complete a thin pack
+	Bytes    int64
+	Id       Id // the pack's checksum, once it's been verified
+}
+
+// IndexPack reads a pack from r, checks it, and stores it and a newly
+// generated index in repo's objects/pack directory. If repo's objects
+// aren't kept in a FileStore, the objects in the pack are added to its
+// store instead.
+func IndexPack(r io.Reader, repo *Repo) (*PackStats, error) {
+	return IndexPackProgress(r, repo, nil)
+}
+
+// IndexPackProgress is like IndexPack, but calls progress, if it's not nil,
+// as each object is received and each delta is resolved.
+func IndexPackProgress(r io.Reader, repo *Repo, progress func(PackStats)) (*PackStats, error) {
+	// other stores get the pack by way of a scratch file system
+	store, _ := repo.objects.(*FileStore)
+	var fsys FileSystem
+	var packDir string
+	if store != nil {
+		fsys, packDir = store.fs, store.packDir()
+	} else {
+		fsys, packDir = NewMemoryFS(), "."
+	}
+	if err := fsys.MkdirAll(packDir, 0777); err != nil {
+		return nil, err
+	}
+	f, err := fsys.TempFile(packDir, "tmp_pack_")
+	if err != nil {
+		return nil, err
+	}
+	tmp := f.Name()
+	defer func() {
+		f.Close()
+		fsys.Remove(tmp)
+	}()
+
+	ix := &indexer{repo: repo, file: f, progress: progress}
+	if err := ix.read(r); err != nil {
+		return nil, err
+	}
+	if err := ix.resolve(); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := ix.install(fsys, packDir, tmp, store); err != nil {
+		return nil, err
+	}
+	if store == nil {
+		if err := ix.copyObjects(fsys, packDir); err != nil {
+			return nil, err
+		}
+	}
+	return &ix.stats, nil
+}
+
+// An indexer keeps track of the objects in a pack as it's read.
+type indexer struct {
+	repo     *Repo
+	file     File
+	progress func(PackStats)
+	stats    PackStats
+
+	entries  []*indexerEntry
+	ofsDelta map[uint64][]*indexerEntry // OFS_DELTA entries by base offset
+	refDelta map[Id][]*indexerEntry     // REF_DELTA entries by base id
+	end      uint64                     // where the objects end and the checksum starts
+	checksum []byte
+}
+
+type indexerEntry struct {
+	offset  uint64
+	data    uint64 // offset of the compressed data
+	objType int    // the real type, once a delta is resolved
+	size    uint64 // inflated size of the entry's data
+	crc     uint32
+	id      Id
+}
+
+func (ix *indexer) report() {
+	if ix.progress != nil {
+		ix.progress(ix.stats)
+	}
+}
+
+// packStream reads a pack, copying it to a file and keeping track of the
+// offset, checksum and CRC-32 of what's been read.
+type packStream struct {
+	r   *bufio.Reader
+	w   io.Writer
+	err error // the first error writing to w
+	n   uint64
+	sum hash.Hash
+	crc hash.Hash32
+}
+
+func (s *packStream) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	s.consumed(b[:n])
+	return n, err
+}
+
+// ReadByte lets zlib read exactly the compressed data and nothing after it.
+func (s *packStream) ReadByte() (byte, error) {
+	c, err := s.r.ReadByte()
+	if err == nil {
+		s.consumed([]byte{c})
+	}
+	return c, err
+}
+
+func (s *packStream) consumed(b []byte) {
+	s.n += uint64(len(b))
+	s.sum.Write(b)
+	s.crc.Write(b)
+	if s.err == nil {
+		_, s.err = s.w.Write(b)
+	}
+}
+
+// read copies the pack to ix.file, noting where each object is. Objects
+// that aren't deltas get their ids along the way.
+func (ix *indexer) read(r io.Reader) error {
+	s := &packStream{r: bufio.NewReader(r), w: ix.file, sum: sha1.New(), crc: crc32.NewIEEE()}
+	var header [12]byte
+	if _, err := io.ReadFull(s, header[:]); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadPackHeader, err)
+	}
+	if string(header[:8]) != packHeader {
+		return ErrBadPackHeader
+	}
+	count := order.Uint32(header[8:])
+	ix.stats.Objects = int(count)
+	ix.ofsDelta = map[uint64][]*indexerEntry{}
+	ix.refDelta = map[Id][]*indexerEntry{}
+
+	for i := uint32(0); i < count; i++ {
+		s.crc.Reset()
+		e := &indexerEntry{offset: s.n}
+		c, err := s.ReadByte()
+		if err != nil {
+			return corrupt("truncated pack: %v", err)
+		}
+		e.objType = int(c & 0x70 >> 4)
+		e.size = uint64(c & 0x0F)
+		for shift := uint(4); c&0x80 != 0; shift += 7 {
+			if c, err = s.ReadByte(); err != nil || shift > 60 {
+				return corrupt("bad object header at offset %d", e.offset)
+			}
+			e.size |= uint64(c&0x7F) << shift
+		}
+
+		h := sha1.New()
+		switch e.objType {
+		case _OBJ_COMMIT, _OBJ_TREE, _OBJ_BLOB, _OBJ_TAG:
+			h.Write([]byte(ObjectType(e.objType).String() + " " + strconv.FormatUint(e.size, 10) + "\x00"))
+		case _OBJ_OFS_DELTA:
+			if c, err = s.ReadByte(); err != nil {
+				return corrupt("truncated delta at offset %d", e.offset)
+			}
+			baseOffset := uint64(c & 0x7F)
+			for c&0x80 != 0 {
+				if c, err = s.ReadByte(); err != nil || baseOffset >= 1<<56 {
+					return corrupt("truncated delta at offset %d", e.offset)
+				}
+				baseOffset = ((baseOffset + 1) << 7) | uint64(c&0x7F)
+			}
+			if baseOffset == 0 || baseOffset > e.offset {
+				return corrupt("bad delta base offset at offset %d", e.offset)
+			}
+			base := e.offset - baseOffset
+			ix.ofsDelta[base] = append(ix.ofsDelta[base], e)
+			ix.stats.Deltas++
+		case _OBJ_REF_DELTA:
+			var baseId [20]byte
+			if _, err := io.ReadFull(s, baseId[:]); err != nil {
+				return corrupt("truncated delta at offset %d", e.offset)
+			}
+			id := Id(string(baseId[:]))
+			ix.refDelta[id] = append(ix.refDelta[id], e)
+			ix.stats.Deltas++
+		default:
+			return corrupt("bad object type %d at offset %d", e.objType, e.offset)
+		}
+
+		e.data = s.n
+		z, err := zlib.NewReader(s)
+		if err != nil {
+			return corrupt("offset %d: %v", e.offset, err)
+		}
+		// zlib checks its own checksum before it reports EOF
+		n, err := io.Copy(h, z)
+		if err != nil || uint64(n) != e.size {
+			return corrupt("object at offset %d doesn't inflate to its size", e.offset)
+		}
+		if e.objType != _OBJ_OFS_DELTA && e.objType != _OBJ_REF_DELTA {
+			e.id = Id(string(h.Sum(nil)))
+		}
+		e.crc = s.crc.Sum32()
+		ix.entries = append(ix.entries, e)
+		ix.stats.Received++
+		ix.stats.Bytes = int64(s.n)
+		ix.report()
+	}
+
+	if s.err != nil {
+		return s.err
+	}
+	ix.end = s.n
+	ix.checksum = s.sum.Sum(nil)
+	var trailer [20]byte
+	if _, err := io.ReadFull(s.r, trailer[:]); err != nil {
+		return corrupt("pack has no trailing checksum")
+	}
+	if !bytes.Equal(trailer[:], ix.checksum) {
+		return corrupt("pack checksum mismatch")
+	}
+	if _, err := ix.file.Write(trailer[:]); err != nil {
+		return err
+	}
+	ix.stats.Bytes += 20
+	ix.stats.Id = Id(string(ix.checksum))
+	return nil
+}
+
+// inflate reads the data of e back from the pack file.
+func (ix *indexer) inflate(e *indexerEntry) ([]byte, error) {
+	z, err := zlib.NewReader(io.NewSectionReader(ix.file, int64(e.data), 1<<62))
+	if err != nil {
+		return nil, corrupt("offset %d: %v", e.offset, err)
+	}
+	defer z.Close()
+	b := make([]byte, e.size)
+	if _, err := io.ReadFull(z, b); err != nil {
+		return nil, corrupt("offset %d: %v", e.offset, err)
+	}
+	return b, nil
+}
+
+// resolve applies every delta, starting from the objects that aren't
+// deltas and working out to the deltas based on them.
+func (ix *indexer) resolve() error {
+	for _, e := range ix.entries {
+		if e.objType == _OBJ_OFS_DELTA || e.objType == _OBJ_REF_DELTA {
+			continue
+		}
+		if len(ix.ofsDelta[e.offset]) == 0 && len(ix.refDelta[e.id]) == 0 {
+			continue
+		}
+		content, err := ix.inflate(e)
+		if err != nil {
+			return err
+		}
+		if err := ix.resolveChildren(e, content); err != nil {
+			return err
+		}
+	}
+	if len(ix.refDelta) > 0 {
+		if err := ix.completeThin(); err != nil {
+			return err
+		}
+	}
+	if ix.stats.Resolved != ix.stats.Deltas {
+		return corrupt("%d deltas have no base in the pack", ix.stats.Deltas-ix.stats.Resolved)
+	}
+	return nil
+}
+
+// completeThin handles a thin pack, where some REF_DELTA bases aren't in the
+// pack but are already in the repository. Those bases are appended to the
+// pack so it can stand on its own, and the header and checksum are
+// rewritten to match.
+func (ix *indexer) completeThin() error {
+	missing := make([]string, 0, len(ix.refDelta))
+	for id := range ix.refDelta {
+		missing = append(missing, string(id))
+	}
+	// keep the resulting pack the same from run to run
+	sort.Strings(missing)
+	var bases []*indexerEntry
+	var contents [][]byte
+	for _, s := range missing {
+		id := Id(s)
+		if _, ok := ix.refDelta[id]; !ok {
+			// a delta in the pack, resolved along with an earlier base
+			continue
+		}
+		obj, err := ix.repo.GetObject(id)
+		if errors.Is(err, ErrObjectNotFound) {
+			// it may be a delta in the pack whose base comes later
+			continue
+		} else if err != nil {
+			return err
+		}
+		content := obj.Raw()
+		// the entry's place in the pack is filled in when it's appended
+		e := &indexerEntry{objType: objectTypeCode(obj.Header()), size: uint64(len(content)), id: id}
+		if err := ix.resolveChildren(e, content); err != nil {
+			return err
+		}
+		bases = append(bases, e)
+		contents = append(contents, content)
+	}
+	for _, s := range missing {
+		if _, ok := ix.refDelta[Id(s)]; ok {
+			return corrupt("delta base %s is in neither the pack nor the repository", Id(s))
+		}
+	}
+
+	// A base can also turn out to be a delta in the pack, resolved from
+	// another base. It's in the pack already, and mustn't be there twice.
+	inPack := make(map[Id]bool, len(ix.entries))
+	for _, e := range ix.entries {
+		inPack[e.id] = true
+	}
+	for i, e := range bases {
+		if inPack[e.id] {
+			continue
+		}
+		b := bytes.NewBuffer(nil)
+		b.Write(packEntryHeader(e.objType, e.size))
+		header := b.Len()
+		if err := writeCompressed(b, contents[i]); err != nil {
+			return err
+		}
+		e.offset, e.data = ix.end, ix.end+uint64(header)
+		e.crc = crc32.ChecksumIEEE(b.Bytes())
+		if _, err := ix.file.WriteAt(b.Bytes(), int64(ix.end)); err != nil {
+			return err
+		}
+		ix.end += uint64(b.Len())
+		ix.entries = append(ix.entries, e)
+		ix.stats.Appended++
+	}
+
+	var count [4]byte
+	order.PutUint32(count[:], uint32(len(ix.entries)))
+	if _, err := ix.file.WriteAt(count[:], 8); err != nil {
+		return err
+	}
+	h := sha1.New()
+	if _, err := io.Copy(h, io.NewSectionReader(ix.file, 0, int64(ix.end))); err != nil {
+		return err
+	}
+	ix.checksum = h.Sum(nil)
+	if _, err := ix.file.WriteAt(ix.checksum, int64(ix.end)); err != nil {
+		return err
+	}
+	if err := ix.file.Truncate(int64(ix.end) + 20); err != nil {
+		return err
+	}
+	ix.stats.Bytes = int64(ix.end) + 20
+	ix.stats.Id = Id(string(ix.checksum))
+	return nil
+}
+
+// resolveChildren resolves the deltas whose base is e, which has the given
+// content.
+func (ix *indexer) resolveChildren(base *indexerEntry, content []byte) error {
+	children := append(ix.ofsDelta[base.offset], ix.refDelta[base.id]...)
+	delete(ix.ofsDelta, base.offset)
+	delete(ix.refDelta, base.id)
+	for _, e := range children {
+		delta, err := ix.inflate(e)
+		if err != nil {
+			return err
+		}
+		result, err := applyDelta(content, delta)
+		if err != nil {
+			return err
+		}
+		e.objType = base.objType
+		h := sha1.New()
+		h.Write([]byte(ObjectType(e.objType).String() + " " + strconv.Itoa(len(result)) + "\x00"))
+		h.Write(result)
+		e.id = Id(string(h.Sum(nil)))
+		ix.stats.Resolved++
+		ix.report()
+		if err := ix.resolveChildren(e, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// install writes the index and moves the pack and index into place. If
+// store is not nil, it's told about the new pack.
+func (ix *indexer) install(fsys FileSystem, packDir, tmpPack string, store *FileStore) error {
+	idx := make([]indexEntry, len(ix.entries))
+	for i, e := range ix.entries {
+		idx[i] = indexEntry{e.id, e.offset, e.crc}
+	}
+	f, err := fsys.TempFile(packDir, "tmp_idx_")
+	if err != nil {
+		return err
+	}
+	tmpIdx := f.Name()
+	defer fsys.Remove(tmpIdx)
+	err = writeIndex(f, idx, ix.checksum)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	base := "pack-" + ix.stats.Id.String()
+	packPath := path.Join(packDir, base)
+	if _, err := fs.Stat(fsys, packPath+".idx"); err == nil {
+		// we already have this pack
+		return nil
+	}
+	if err := fsys.Chmod(tmpPack, 0444); err != nil {
+		return err
+	}
+	if err := fsys.Chmod(tmpIdx, 0444); err != nil {
+		return err
+	}
+	// Readers find packs by their index, so the pack has to be there first.
+	if err := fsys.Rename(tmpPack, packPath+".pack"); err != nil {
+		return err
+	}
+	if err := fsys.Rename(tmpIdx, packPath+".idx"); err != nil {
+		return err
+	}
+	if store != nil {
+		store.addPack(base)
+	}
+	return nil
+}
+
+// copyObjects adds every object in the installed pack to the repository's
+// store.
+func (ix *indexer) copyObjects(fsys FileSystem, packDir string) error {
+	p := newPack(fsys, packDir, "pack-"+ix.stats.Id.String())
+	defer p.Close()
+	for _, e := range ix.entries {
+		obj, err := p.readObject(e.offset)
+		if err != nil {
+			return err
+		}
+		if _, err := ix.repo.objects.Put(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
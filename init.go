@@ -0,0 +1,273 @@
+package git
+
+// This file implements creating repositories laid out the way git init
+// creates them.
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// InitOptions control how InitRepoWithOptions creates a repository. The
+// zero value creates the same repository as git init does with no
+// configuration.
+type InitOptions struct {
+	// Bare creates a repository without a working tree, like
+	// git init --bare.
+	Bare bool
+	// InitialBranch is the branch HEAD starts out pointing to. The default
+	// is master.
+	InitialBranch string
+	// ObjectFormat is the hash that names objects. Only "sha1", the
+	// default, is supported.
+	ObjectFormat string
+	// Shared lets several users share the repository, and takes the same
+	// values as git init --shared: "umask" (or "false"), the default, leaves
+	// permissions to the umask; "group" (or "true") makes the repository
+	// writable by its group; "all" (or "world" or "everybody") also makes it
+	// readable by everyone; and an octal mode such as "0640" sets the
+	// permissions exactly. Only the files InitRepoWithOptions creates are
+	// given these permissions.
+	Shared string
+	// TemplateDir is a directory whose contents are copied into the new
+	// repository in place of the default description, hooks and info
+	// directories, as with git init --template. A config file in it is
+	// ignored.
+	TemplateDir string
+}
+
+// InitRepo creates a repository like git init does and returns it. Unless
+// bare is true, path is the working tree and the repository is created in
+// path/.git. If there's already a repository there, InitRepo returns it
+// without changing it.
+func InitRepo(path string, bare bool) (*Repo, error) {
+	return InitRepoWithOptions(path, InitOptions{Bare: bare})
+}
+
+// InitRepoWithOptions is like InitRepo, but takes more options.
+func InitRepoWithOptions(path string, opts InitOptions) (*Repo, error) {
+	gitDir := path
+	if !opts.Bare {
+		gitDir = filepath.Join(path, ".git")
+	}
+	if err := os.MkdirAll(gitDir, 0777); err != nil {
+		return nil, err
+	}
+	r, err := initRepo(NewOSFS(gitDir), opts)
+	if err != nil {
+		return nil, err
+	}
+	r.path = gitDir
+	r.readBare()
+	return r, nil
+}
+
+// InitRepoFS is like InitRepo, but creates the repository at the root of
+// fsys.
+func InitRepoFS(fsys FileSystem, bare bool) (*Repo, error) {
+	return initRepo(fsys, InitOptions{Bare: bare})
+}
+
+func initRepo(fsys FileSystem, opts InitOptions) (*Repo, error) {
+	if r, err := NewRepoFS(fsys); err == nil {
+		return r, nil
+	}
+	branch := opts.InitialBranch
+	if branch == "" {
+		branch = "master"
+	}
+	if err := checkBranchName(branch); err != nil {
+		return nil, err
+	}
+	if opts.ObjectFormat != "" && opts.ObjectFormat != "sha1" {
+		return nil, fmt.Errorf("git: unsupported object format %q", opts.ObjectFormat)
+	}
+	shared, err := parseShared(opts.Shared)
+	if err != nil {
+		return nil, err
+	}
+
+	mkdir := func(name string) error {
+		if err := fsys.MkdirAll(name, 0777); err != nil {
+			return err
+		}
+		return shared.adjust(fsys, name)
+	}
+	write := func(name string, content []byte, perm fs.FileMode) error {
+		if err := writeFile(fsys, name, content, perm); err != nil {
+			return err
+		}
+		return shared.adjust(fsys, name)
+	}
+	if err := shared.adjust(fsys, "."); err != nil {
+		return nil, err
+	}
+	if opts.TemplateDir != "" {
+		if err := copyTemplate(os.DirFS(opts.TemplateDir), mkdir, write); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, dir := range []string{"branches", "hooks", "info"} {
+			if err := mkdir(dir); err != nil {
+				return nil, err
+			}
+		}
+		if err := write("description", []byte(defaultDescription), 0666); err != nil {
+			return nil, err
+		}
+		if err := write("info/exclude", []byte(defaultExclude), 0666); err != nil {
+			return nil, err
+		}
+	}
+	for _, dir := range []string{"objects", "objects/info", "objects/pack", "refs", "refs/heads", "refs/tags"} {
+		if err := mkdir(dir); err != nil {
+			return nil, err
+		}
+	}
+	if err := write("HEAD", []byte("ref: refs/heads/"+branch+"\n"), 0666); err != nil {
+		return nil, err
+	}
+
+	var config strings.Builder
+	fmt.Fprintf(&config, "[core]\n\trepositoryformatversion = 0\n\tfilemode = true\n\tbare = %t\n", opts.Bare)
+	if !opts.Bare {
+		config.WriteString("\tlogallrefupdates = true\n")
+	}
+	if shared.config != "" {
+		fmt.Fprintf(&config, "\tsharedrepository = %s\n[receive]\n\tdenyNonFastforwards = true\n", shared.config)
+	}
+	if err := write("config", []byte(config.String()), 0666); err != nil {
+		return nil, err
+	}
+
+	r := NewRepoWithStore(fsys, NewFileStoreFS(fsys, "objects"))
+	r.bare = opts.Bare
+	return r, nil
+}
+
+const defaultDescription = "Unnamed repository; edit this file 'description' to name the repository.\n"
+
+const defaultExclude = `# git ls-files --others --exclude-from=.git/info/exclude
+# Lines that start with '#' are comments.
+# For a project mostly in C, the following would be a good set of
+# exclude patterns (uncomment them if you want to use them):
+# *.[oa]
+# *~
+`
+
+// copyTemplate copies the files in template using mkdir and write, keeping
+// their permissions.
+func copyTemplate(template fs.FS, mkdir func(string) error, write func(string, []byte, fs.FileMode) error) error {
+	return fs.WalkDir(template, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case name == ".":
+			return nil
+		case name == "config":
+			return nil
+		case d.IsDir():
+			return mkdir(name)
+		case !d.Type().IsRegular():
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		content, err := fs.ReadFile(template, name)
+		if err != nil {
+			return err
+		}
+		return write(name, content, info.Mode().Perm())
+	})
+}
+
+// sharedPerm is a core.sharedRepository setting.
+type sharedPerm struct {
+	perm   fs.FileMode // the permissions to add, or 0 to leave them to the umask
+	exact  bool        // whether perm replaces the permissions instead
+	config string      // how the setting is written in config
+}
+
+func parseShared(s string) (sharedPerm, error) {
+	switch strings.ToLower(s) {
+	case "", "umask", "false", "no", "off":
+		return sharedPerm{}, nil
+	case "group", "true", "yes", "on":
+		return sharedPerm{perm: 0660, config: "1"}, nil
+	case "all", "world", "everybody":
+		return sharedPerm{perm: 0664, config: "2"}, nil
+	}
+	perm, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || perm&^0777 != 0 {
+		return sharedPerm{}, fmt.Errorf("git: bad shared setting %q", s)
+	}
+	if perm&0600 != 0600 {
+		return sharedPerm{}, fmt.Errorf("git: shared setting %q doesn't let the owner read and write", s)
+	}
+	return sharedPerm{fs.FileMode(perm), true, fmt.Sprintf("0%03o", perm)}, nil
+}
+
+// adjust changes the permissions of name to match p, the way git does.
+// Directories are also made setgid, so files created in them keep their
+// group.
+func (p sharedPerm) adjust(fsys FileSystem, name string) error {
+	if p.perm == 0 {
+		return nil
+	}
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return err
+	}
+	mode := info.Mode().Perm()
+	perm := p.perm
+	if mode&0200 == 0 {
+		perm &^= 0222
+	}
+	if mode&0100 != 0 {
+		// readers can search directories and run executables
+		perm |= (perm & 0444) >> 2
+	}
+	if p.exact {
+		mode = perm
+	} else {
+		mode |= perm
+	}
+	if info.IsDir() {
+		mode |= fs.ModeSetgid
+	}
+	return fsys.Chmod(name, mode)
+}
+
+// checkBranchName returns an error if name can't be the name of a branch.
+func checkBranchName(name string) error {
+	if name == "HEAD" || strings.HasPrefix(name, "-") || !validRefName("refs/heads/"+name) {
+		return fmt.Errorf("git: invalid branch name %q", name)
+	}
+	return nil
+}
+
+// validRefName reports whether name is a valid ref name, by the rules of
+// git check-ref-format.
+func validRefName(name string) bool {
+	if name == "@" || strings.HasSuffix(name, ".") || strings.Contains(name, "..") || strings.Contains(name, "@{") {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if c < ' ' || c == 0x7f || strings.IndexByte(" ~^:?*[\\", c) >= 0 {
+			return false
+		}
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part[0] == '.' || strings.HasSuffix(part, ".lock") {
+			return false
+		}
+	}
+	return true
+}
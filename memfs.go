@@ -0,0 +1,406 @@
+package git
+
+// This file implements a FileSystem that keeps files in memory.
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A MemoryFS is a FileSystem that keeps everything in memory. It's safe
+// for concurrent use.
+type MemoryFS struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode // by name; the root is "."
+	temp  int                 // counter for TempFile names
+}
+
+type memNode struct {
+	mode    fs.FileMode
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemoryFS returns an empty MemoryFS.
+func NewMemoryFS() *MemoryFS {
+	return &MemoryFS{nodes: map[string]*memNode{
+		".": {mode: fs.ModeDir | 0777, modTime: time.Now()},
+	}}
+}
+
+func (m *MemoryFS) Open(name string) (fs.File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *MemoryFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.nodes[name]
+	if n == nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return n.info(name), nil
+}
+
+func (m *MemoryFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.readDir(name)
+}
+
+func (m *MemoryFS) readDir(name string) ([]fs.DirEntry, error) {
+	if n := m.nodes[name]; n == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	} else if !n.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	var entries []fs.DirEntry
+	for child, n := range m.nodes {
+		if child != "." && path.Dir(child) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(n.info(child)))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (m *MemoryFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.nodes[name]
+	switch {
+	case n == nil && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case n == nil:
+		if parent := m.nodes[path.Dir(name)]; parent == nil || !parent.mode.IsDir() {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		n = &memNode{mode: perm & fs.ModePerm, modTime: time.Now()}
+		m.nodes[name] = n
+		m.touch(name)
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case n.mode.IsDir() && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	if flag&os.O_TRUNC != 0 && !n.mode.IsDir() {
+		n.data = nil
+		n.modTime = time.Now()
+	}
+	f := &memFile{fs: m, name: name, node: n, flag: flag}
+	if flag&os.O_APPEND != 0 {
+		f.pos = int64(len(n.data))
+	}
+	return f, nil
+}
+
+func (m *MemoryFS) TempFile(dir, pattern string) (File, error) {
+	for {
+		m.mu.Lock()
+		m.temp++
+		suffix := strconv.Itoa(m.temp)
+		m.mu.Unlock()
+		var name string
+		if i := strings.LastIndexByte(pattern, '*'); i >= 0 {
+			name = pattern[:i] + suffix + pattern[i+1:]
+		} else {
+			name = pattern + suffix
+		}
+		f, err := m.OpenFile(path.Join(dir, name), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if !errors.Is(err, fs.ErrExist) {
+			return f, err
+		}
+	}
+}
+
+func (m *MemoryFS) MkdirAll(name string, perm fs.FileMode) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var missing []string
+	for dir := name; ; dir = path.Dir(dir) {
+		if n := m.nodes[dir]; n != nil {
+			if !n.mode.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+			}
+			break
+		}
+		missing = append(missing, dir)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		m.nodes[missing[i]] = &memNode{mode: fs.ModeDir | perm&fs.ModePerm, modTime: time.Now()}
+		m.touch(missing[i])
+	}
+	return nil
+}
+
+// Rename only renames files, not directories.
+func (m *MemoryFS) Rename(oldname, newname string) error {
+	if !fs.ValidPath(oldname) || !fs.ValidPath(newname) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrInvalid}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.nodes[oldname]
+	if n == nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	if n.mode.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EISDIR}
+	}
+	if parent := m.nodes[path.Dir(newname)]; parent == nil || !parent.mode.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	if old := m.nodes[newname]; old != nil && old.mode.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EISDIR}
+	}
+	delete(m.nodes, oldname)
+	m.nodes[newname] = n
+	m.touch(oldname)
+	m.touch(newname)
+	return nil
+}
+
+func (m *MemoryFS) Remove(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.nodes[name]
+	if n == nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if n.mode.IsDir() {
+		if entries, _ := m.readDir(name); len(entries) > 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	delete(m.nodes, name)
+	m.touch(name)
+	return nil
+}
+
+// touch updates the modification time of name's directory, as adding or
+// removing name does on disk. m.mu must be held.
+func (m *MemoryFS) touch(name string) {
+	if dir := m.nodes[path.Dir(name)]; dir != nil {
+		dir.modTime = time.Now()
+	}
+}
+
+func (m *MemoryFS) Chmod(name string, mode fs.FileMode) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrInvalid}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.nodes[name]
+	if n == nil {
+		return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrNotExist}
+	}
+	n.mode = n.mode&fs.ModeType | mode&fs.ModePerm
+	return nil
+}
+
+func (n *memNode) info(name string) fs.FileInfo {
+	return memInfo{path.Base(name), int64(len(n.data)), n.mode, n.modTime}
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() fs.FileMode  { return i.mode }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memInfo) Sys() interface{}   { return nil }
+
+// A memFile is an open file in a MemoryFS.
+type memFile struct {
+	fs     *MemoryFS
+	name   string
+	node   *memNode
+	flag   int
+	pos    int64
+	dirPos int // entries already returned by ReadDir
+	closed bool
+}
+
+func (f *memFile) Name() string { return f.name }
+
+func (f *memFile) check(op string, write bool) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	if write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrPermission}
+	}
+	if !write && f.flag&os.O_WRONLY != 0 {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.node.info(f.name), nil
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.node.mode.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.node.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	if f.flag&os.O_APPEND != 0 {
+		f.fs.mu.Lock()
+		f.pos = int64(len(f.node.data))
+		f.fs.mu.Unlock()
+	}
+	n, err := f.WriteAt(b, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if end := off + int64(len(b)); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[off:], b)
+	f.node.modTime = time.Now()
+	return len(b), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		f.fs.mu.Lock()
+		offset += int64(len(f.node.data))
+		f.fs.mu.Unlock()
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+// ReadDir makes directories opened from a MemoryFS fs.ReadDirFiles.
+func (f *memFile) ReadDir(count int) ([]fs.DirEntry, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.fs.mu.Lock()
+	entries, err := f.fs.readDir(f.name)
+	f.fs.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	// entries may have been removed since the last call
+	if f.dirPos > len(entries) {
+		f.dirPos = len(entries)
+	}
+	entries = entries[f.dirPos:]
+	if count > 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+	f.dirPos += len(entries)
+	if count > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	return entries, nil
+}
+
+func (f *memFile) Sync() error { return nil }
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
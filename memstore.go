@@ -0,0 +1,91 @@
+package git
+
+// This file implements an ObjectStore that keeps objects in memory.
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// A MemoryStore keeps objects in memory. It's useful for tests and for
+// repositories that don't need to outlive the process. It's safe for
+// concurrent use.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	objects map[Id]memoryObject
+}
+
+type memoryObject struct {
+	objType int
+	content []byte
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{objects: map[Id]memoryObject{}}
+}
+
+// Get parses a copy of the object each time, so callers can't change
+// what's stored.
+func (s *MemoryStore) Get(id Id) (Object, error) {
+	s.mu.RLock()
+	o, ok := s.objects[id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, id)
+	}
+	return parseContent(o.objType, append([]byte(nil), o.content...))
+}
+
+func (s *MemoryStore) Stat(id Id) (ObjectType, int64, error) {
+	s.mu.RLock()
+	o, ok := s.objects[id]
+	s.mu.RUnlock()
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %s", ErrObjectNotFound, id)
+	}
+	return ObjectType(o.objType), int64(len(o.content)), nil
+}
+
+func (s *MemoryStore) Has(id Id) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.objects[id]
+	return ok
+}
+
+func (s *MemoryStore) Put(obj Object) (Id, error) {
+	objType := objectTypeCode(obj.Header())
+	if objType == 0 {
+		return "", fmt.Errorf("git: unknown object type %q", obj.Header())
+	}
+	id := ObjectId(obj)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[id]; !ok {
+		content := append([]byte(nil), obj.Raw()...)
+		s.objects[id] = memoryObject{objType, content}
+	}
+	return id, nil
+}
+
+// Iterate visits objects in order of their ids. Objects added while it
+// runs may not be visited.
+func (s *MemoryStore) Iterate(fn func(id Id, objType ObjectType) error) error {
+	s.mu.RLock()
+	ids := make([]string, 0, len(s.objects))
+	types := make(map[Id]int, len(s.objects))
+	for id, o := range s.objects {
+		ids = append(ids, string(id))
+		types[id] = o.objType
+	}
+	s.mu.RUnlock()
+	sort.Strings(ids)
+	for _, id := range ids {
+		if err := fn(Id(id), ObjectType(types[Id(id)])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,9 +3,37 @@ package git
 import (
 	"bytes"
 	"crypto/sha1"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// An ObjectType is the type of an object: commit, tree, blob or tag.
+type ObjectType int
+
+const (
+	CommitObject ObjectType = _OBJ_COMMIT
+	TreeObject   ObjectType = _OBJ_TREE
+	BlobObject   ObjectType = _OBJ_BLOB
+	TagObject    ObjectType = _OBJ_TAG
+)
+
+// String returns the name used in object headers, such as "commit".
+func (t ObjectType) String() string {
+	switch t {
+	case CommitObject:
+		return "commit"
+	case TreeObject:
+		return "tree"
+	case BlobObject:
+		return "blob"
+	case TagObject:
+		return "tag"
+	}
+	return "unknown"
+}
+
 type Object interface {
 	Header() string
 	Raw() []byte
@@ -14,7 +42,7 @@ type Object interface {
 func ObjectId(obj Object) Id {
 	h := sha1.New()
 	h.Write(ObjectFull(obj))
-	return IdFromBytes(h.Sum(nil))
+	return Id(string(h.Sum(nil)))
 }
 
 func ObjectFull(obj Object) []byte {
@@ -43,92 +71,267 @@ func (b *Blob) Raw() []byte {
 	return b.raw
 }
 
+// A FileMode is the mode of a tree entry.
+type FileMode uint32
+
+const (
+	ModeFile       FileMode = 0100644
+	ModeExecutable FileMode = 0100755
+	ModeSymlink    FileMode = 0120000
+	ModeDir        FileMode = 0040000
+	ModeGitlink    FileMode = 0160000 // a submodule commit
+)
+
+// IsDir reports whether m describes a subtree.
+func (m FileMode) IsDir() bool { return m&0170000 == ModeDir }
+
+// String returns m as it's written in a tree object, such as "100644" or "40000".
+func (m FileMode) String() string { return strconv.FormatUint(uint64(m), 8) }
+
+// A TreeEntry is a single named child of a Tree.
+type TreeEntry struct {
+	Name string
+	Mode FileMode
+	Id   Id
+}
+
 type Tree struct {
-	names    []string
-	children []Id
+	entries []TreeEntry
+	// for a parsed tree, each entry's mode as it was written, such as
+	// "040000", so it's serialized exactly as it was read, in its own order
+	modes []string
 }
 
 func NewTree(cap int) *Tree {
 	t := &Tree{}
 	if cap > 0 {
-		t.names = make([]string, 0, cap)
-		t.children = make([]Id, 0, cap)
+		t.entries = make([]TreeEntry, 0, cap)
 	}
 	return t
 }
 
-func (t *Tree) Add(name string, child Id) {
-	t.names = append(t.names, name)
-	t.children = append(t.children, child)
+// Add adds an entry to t. A tree that's been added to is serialized the way
+// git writes trees, even if it was parsed from one written differently.
+func (t *Tree) Add(name string, mode FileMode, child Id) {
+	t.entries = append(t.entries, TreeEntry{name, mode, child})
+	t.modes = nil
+}
+
+// Len returns the number of entries in t.
+func (t *Tree) Len() int { return len(t.entries) }
+
+// Entry returns the ith entry of t, in the order the entries were added or parsed.
+func (t *Tree) Entry(i int) TreeEntry { return t.entries[i] }
+
+// Entries returns a copy of t's entries in canonical order.
+func (t *Tree) Entries() []TreeEntry {
+	entries := append([]TreeEntry(nil), t.entries...)
+	sort.Stable(treeOrder(entries))
+	return entries
+}
+
+// Lookup returns the entry with the given name.
+func (t *Tree) Lookup(name string) (TreeEntry, bool) {
+	for _, e := range t.entries {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return TreeEntry{}, false
+}
+
+// treeOrder sorts entries the way git does: by name, except that
+// directories compare as if their names ended in "/".
+type treeOrder []TreeEntry
+
+func (o treeOrder) Len() int      { return len(o) }
+func (o treeOrder) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o treeOrder) Less(i, j int) bool {
+	return treeSortKey(o[i]) < treeSortKey(o[j])
+}
+
+func treeSortKey(e TreeEntry) string {
+	if e.Mode.IsDir() {
+		return e.Name + "/"
+	}
+	return e.Name
 }
 
 func (t *Tree) Header() string { return "tree" }
 
 func (t *Tree) Raw() []byte {
 	content := bytes.NewBuffer(nil)
-	// TODO: Print out the children in sorted order
-	for i := range t.names {
-		// TODO: Fix permissions
-		content.WriteString("100644 ")
-		content.WriteString(t.names[i])
+	if t.modes != nil {
+		for i, e := range t.entries {
+			content.WriteString(t.modes[i])
+			content.WriteByte(' ')
+			content.WriteString(e.Name)
+			content.WriteByte('\x00')
+			content.WriteString(string(e.Id))
+		}
+		return content.Bytes()
+	}
+	for _, e := range t.Entries() {
+		content.WriteString(e.Mode.String())
+		content.WriteByte(' ')
+		content.WriteString(e.Name)
 		content.WriteByte('\x00')
-		content.WriteString(t.children[i].String())
+		content.WriteString(string(e.Id))
 	}
 	return content.Bytes()
 }
 
-type time struct {
-	seconds int64
-	offset  int // time zone offset in minutes
+// A Signature identifies who created a commit or tag, and when.
+type Signature struct {
+	Name  string
+	Email string
+	When  time.Time
 }
 
-func (t *time) String() string {
-	if t == nil {
-		return ""
-	}
-	pre := " "
-	offset := t.offset
-	if t.offset < 0 {
-		pre += "-"
-		offset = -t.offset
-	}
-	tz := strconv.Itoa(offset)
-	for i := 0; len(tz)+i < 4; i++ {
-		pre += "0"
+// String formats s the way it appears in commit and tag headers.
+func (s Signature) String() string {
+	return s.Name + " <" + s.Email + "> " + strconv.FormatInt(s.When.Unix(), 10) + " " + s.When.Format("-0700")
+}
+
+// An ExtraHeader is a header line of a commit or tag object. Values that
+// span several lines are joined with "\n".
+type ExtraHeader struct {
+	Key   string
+	Value string
+}
+
+func writeHeaders(b *bytes.Buffer, headers []ExtraHeader) {
+	for _, h := range headers {
+		b.WriteString(h.Key)
+		b.WriteByte(' ')
+		// continuation lines start with a space
+		b.WriteString(strings.Replace(h.Value, "\n", "\n ", -1))
+		b.WriteByte('\n')
 	}
-	return strconv.FormatInt(t.seconds, 10) + pre + tz
 }
 
 type Commit struct {
-	authorName     string
-	authorEmail    string
-	authorTime     *time
-	committerName  string
-	committerEmail string
-	committerTime  *time
-	tree           Id
-	parents        []Id
-	msg            string
-}
-
-func NewCommit(authorName, authorEmail string, authorTime *time, committerName, committerEmail string, commitTime *time, tree Id, parents []Id, msg string) *Commit {
+	author    Signature
+	committer Signature
+	tree      Id
+	parents   []Id
+	// every header in the order it appears, so parsed commits are
+	// serialized exactly as they were read
+	headers []ExtraHeader
+	msg     string
+}
+
+// NewCommit creates a commit. Any extra headers, such as "encoding" or
+// "gpgsig", are written after the committer.
+func NewCommit(author, committer Signature, tree Id, parents []Id, msg string, extra ...ExtraHeader) *Commit {
 	// TODO: Set unset things
-	return &Commit{authorName, authorEmail, authorTime, committerName, committerEmail, commitTime, tree, parents, msg}
+	c := &Commit{author: author, committer: committer, tree: tree, parents: parents, msg: msg}
+	c.headers = append(c.headers, ExtraHeader{"tree", tree.String()})
+	for _, p := range parents {
+		c.headers = append(c.headers, ExtraHeader{"parent", p.String()})
+	}
+	c.headers = append(c.headers, ExtraHeader{"author", author.String()}, ExtraHeader{"committer", committer.String()})
+	c.headers = append(c.headers, extra...)
+	return c
 }
 
-func NewCommitSimple(name, email string, time *time, tree Id, parent Id) *Commit {
-	return &Commit{name, email, time, name, email, time, tree, []Id{parent}, "empty message"}
+func NewCommitSimple(sig Signature, tree Id, parent Id) *Commit {
+	return NewCommit(sig, sig, tree, []Id{parent}, "empty message")
 }
 
 func (c *Commit) Header() string { return "commit" }
 
+// Tree returns the id of the commit's top-level tree.
+func (c *Commit) Tree() Id { return c.tree }
+
+// Parents returns the ids of the commit's parents.
+func (c *Commit) Parents() []Id { return append([]Id(nil), c.parents...) }
+
+func (c *Commit) Author() Signature    { return c.author }
+func (c *Commit) Committer() Signature { return c.committer }
+
+// Message returns the commit message.
+func (c *Commit) Message() string { return c.msg }
+
+// ExtraHeaders returns the headers other than tree, parent, author and
+// committer, such as "encoding", "gpgsig" and "mergetag", in order.
+func (c *Commit) ExtraHeaders() []ExtraHeader {
+	var extra []ExtraHeader
+	for _, h := range c.headers {
+		switch h.Key {
+		case "tree", "parent", "author", "committer":
+		default:
+			extra = append(extra, h)
+		}
+	}
+	return extra
+}
+
+// Encoding returns the character encoding of the message, or "" if it
+// isn't given (which means UTF-8).
+func (c *Commit) Encoding() string {
+	for _, h := range c.headers {
+		if h.Key == "encoding" {
+			return h.Value
+		}
+	}
+	return ""
+}
+
 func (c *Commit) Raw() []byte {
-	content := "tree " + c.tree.String()
-	for i := range c.parents {
-		content += "\nparent " + c.parents[i].String()
+	content := bytes.NewBuffer(nil)
+	writeHeaders(content, c.headers)
+	content.WriteByte('\n')
+	content.WriteString(c.msg)
+	return content.Bytes()
+}
+
+// A Tag is an annotated tag object.
+type Tag struct {
+	object    Id
+	objType   string
+	name      string
+	tagger    *Signature // nil for very old tags
+	headers   []ExtraHeader
+	msg       string
+	signature string
+}
+
+// NewTag creates an annotated tag named name pointing at obj.
+func NewTag(name string, obj Object, tagger *Signature, msg string) *Tag {
+	t := &Tag{object: ObjectId(obj), objType: obj.Header(), name: name, tagger: tagger, msg: msg}
+	t.headers = []ExtraHeader{{"object", t.object.String()}, {"type", t.objType}, {"tag", name}}
+	if tagger != nil {
+		t.headers = append(t.headers, ExtraHeader{"tagger", tagger.String()})
 	}
-	content += "\nauthor " + c.authorName + " <" + c.authorEmail + "> " + c.authorTime.String()
-	content += "\ncommitter " + c.committerName + " <" + c.committerEmail + "> " + c.committerTime.String() + "\n\n"
-	content += c.msg
-	return []byte(content)
+	return t
+}
+
+func (t *Tag) Header() string { return "tag" }
+
+// Target returns the id of the tagged object.
+func (t *Tag) Target() Id { return t.object }
+
+// TargetType returns the type of the tagged object, such as "commit".
+func (t *Tag) TargetType() string { return t.objType }
+
+// Name returns the name of the tag, such as "v1.0".
+func (t *Tag) Name() string { return t.name }
+
+// Tagger returns who created the tag, or nil if the tag doesn't say.
+func (t *Tag) Tagger() *Signature { return t.tagger }
+
+// Message returns the tag message, not including any signature.
+func (t *Tag) Message() string { return t.msg }
+
+// Signature returns the armored signature appended to the message, if any.
+func (t *Tag) Signature() string { return t.signature }
+
+func (t *Tag) Raw() []byte {
+	content := bytes.NewBuffer(nil)
+	writeHeaders(content, t.headers)
+	content.WriteByte('\n')
+	content.WriteString(t.msg)
+	content.WriteString(t.signature)
+	return content.Bytes()
 }
@@ -0,0 +1,172 @@
+package git
+
+// This file implements finding and opening a repository the way git's
+// commands do.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// OpenRepo opens the repository that path belongs to. path can be a git
+// directory, a working tree, or any directory inside a working tree: like
+// git, OpenRepo looks for a .git directory, or a .git file pointing to one,
+// in path and then in each of its parents. Linked worktrees and submodules,
+// whose .git is a file, are supported.
+//
+// OpenRepo also honors git's environment variables. GIT_DIR names the git
+// directory, turning off the search; the working tree is then
+// GIT_WORK_TREE, or path if that isn't set. GIT_OBJECT_DIRECTORY replaces
+// the objects directory, and GIT_ALTERNATE_OBJECT_DIRECTORIES lists more
+// directories to look for objects in.
+//
+// It returns an error wrapping ErrNotARepo if no repository is found.
+func OpenRepo(path string) (*Repo, error) {
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	var gitDir, workDir, workTree string
+	if env := os.Getenv("GIT_DIR"); env != "" {
+		if gitDir, err = filepath.Abs(env); err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(gitDir); err == nil && !info.IsDir() {
+			if gitDir, err = readGitFile(gitDir); err != nil {
+				return nil, err
+			}
+		}
+		if !isGitDir(gitDir) {
+			return nil, fmt.Errorf("%w: %s", ErrNotARepo, env)
+		}
+		workDir = dir
+		if env := os.Getenv("GIT_WORK_TREE"); env != "" {
+			if workTree, err = filepath.Abs(env); err != nil {
+				return nil, err
+			}
+			workDir = workTree
+		}
+	} else if gitDir, workDir, err = discover(dir); err != nil {
+		if errors.Is(err, ErrNotARepo) {
+			err = fmt.Errorf("%w: %s", ErrNotARepo, path)
+		}
+		return nil, err
+	}
+	r, err := openGitDir(gitDir, workDir)
+	if err != nil {
+		return nil, err
+	}
+	if workTree != "" {
+		// as in git, an explicit working tree wins over core.bare
+		r.bare, r.workDir = false, workTree
+	}
+	return r, nil
+}
+
+// discover looks for a repository in dir and its parents. It returns the
+// git directory and the working tree, which is "" if the repository is
+// bare or dir is inside the git directory.
+func discover(dir string) (gitDir, workDir string, err error) {
+	for {
+		dotGit := filepath.Join(dir, ".git")
+		if info, err := os.Stat(dotGit); err == nil {
+			if !info.IsDir() {
+				if dotGit, err = readGitFile(dotGit); err != nil {
+					return "", "", err
+				}
+			}
+			if isGitDir(dotGit) {
+				return dotGit, dir, nil
+			}
+		}
+		if isGitDir(dir) {
+			return dir, "", nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", ErrNotARepo
+		}
+		dir = parent
+	}
+}
+
+// readGitFile reads a .git file, which holds "gitdir: " and the path of the
+// real git directory, relative to the file's directory.
+func readGitFile(name string) (string, error) {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	dir, ok := bytes.CutPrefix(content, []byte("gitdir: "))
+	if !ok {
+		return "", fmt.Errorf("git: %s: bad .git file", name)
+	}
+	gitDir := filepath.FromSlash(strings.TrimSpace(string(dir)))
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(filepath.Dir(name), gitDir)
+	}
+	return filepath.Clean(gitDir), nil
+}
+
+// commonDir returns the directory that holds the refs and objects for the
+// git directory gitDir. For a linked worktree, it's the main repository's
+// git directory, which gitDir's commondir file points to.
+func commonDir(gitDir string) (string, error) {
+	content, err := os.ReadFile(filepath.Join(gitDir, "commondir"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return gitDir, nil
+	} else if err != nil {
+		return "", err
+	}
+	dir := filepath.FromSlash(strings.TrimSpace(string(content)))
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(gitDir, dir)
+	}
+	return filepath.Clean(dir), nil
+}
+
+// isGitDir reports whether dir looks like a git directory.
+func isGitDir(dir string) bool {
+	common, err := commonDir(dir)
+	if err != nil {
+		return false
+	}
+	return isRepoFS(NewOSFS(dir), NewOSFS(common), os.Getenv("GIT_OBJECT_DIRECTORY") != "")
+}
+
+// openGitDir opens the repository in gitDir, whose working tree is workDir.
+func openGitDir(gitDir, workDir string) (*Repo, error) {
+	common, err := commonDir(gitDir)
+	if err != nil {
+		return nil, err
+	}
+	objects := filepath.Join(common, "objects")
+	if env := os.Getenv("GIT_OBJECT_DIRECTORY"); env != "" {
+		if objects, err = filepath.Abs(env); err != nil {
+			return nil, err
+		}
+	}
+	store := NewFileStore(objects)
+	for _, dir := range filepath.SplitList(os.Getenv("GIT_ALTERNATE_OBJECT_DIRECTORIES")) {
+		if dir == "" {
+			continue
+		}
+		if dir, err = filepath.Abs(dir); err != nil {
+			return nil, err
+		}
+		store.extra = append(store.extra, dir)
+	}
+	r := NewRepoWithStore(NewOSFS(gitDir), store)
+	r.path = gitDir
+	r.workDir = workDir
+	if common != gitDir {
+		r.common = NewOSFS(common)
+	}
+	r.readBare()
+	return r, nil
+}
@@ -1,71 +1,195 @@
 package git
 
 import (
+	"bufio"
 	"bytes"
 	"compress/zlib"
 	"encoding/binary"
+	"encoding/hex"
+	"fmt"
 	"github.com/edsrzf/mmap-go"
-	"os"
-	"path/filepath"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
 )
 
 var order = binary.BigEndian
 
 type pack struct {
-	idxPath   string
-	indexFile *os.File
-	index     mmap.MMap
+	fs    FileSystem
+	bases *lru // delta bases, if they're cached
 
-	dataPath string
-	dataFile *os.File
-	data     mmap.MMap
-}
+	// mu guards the lazy initialization of the fields below. Once
+	// readIndex or readData has returned, its fields don't change until
+	// Close.
+	mu sync.Mutex
+
+	idxPath    string
+	index      []byte
+	closeIndex func() error
+	version    int               // index version, 1 or 2
+	fanout     uint32            // offset of the fan-out table in index
+	count      uint32            // number of objects
+	byOffset   map[uint64]uint32 // index positions by offset, built lazily
 
-func newPack(r *Repo, base string) *pack {
-	basePath := filepath.Join(r.file("objects"), "pack", base)
-	return &pack{idxPath: basePath + ".idx", dataPath: basePath + ".pack"}
+	dataPath  string
+	data      []byte
+	closeData func() error
 }
 
-const indexHeader = "\xFF\x74\x4F\x63\x00\x00\x00\x02"
+func newPack(fsys FileSystem, dir, base string) *pack {
+	basePath := path.Join(dir, base)
+	return &pack{fs: fsys, idxPath: basePath + ".idx", dataPath: basePath + ".pack"}
+}
 
-func (p *pack) readIndex() {
-	if p.indexFile != nil {
-		return
+// mapFile returns the contents of a file that isn't going to change, and a
+// function that releases them. Files on disk are mapped into memory rather
+// than read.
+func mapFile(fsys FileSystem, name string) ([]byte, func() error, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
 	}
-	var err error
-	p.indexFile, err = os.Open(p.idxPath)
+	if osf, ok := f.(osFile); ok {
+		m, err := mmap.Map(osf.File, mmap.RDONLY, 0)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return m, func() error {
+			err := m.Unmap()
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			return err
+		}, nil
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
 	if err != nil {
-		panic(err.Error())
-		return
+		return nil, nil, err
 	}
-	p.index, err = mmap.Map(p.indexFile, mmap.RDONLY, 0)
+	return b, func() error { return nil }, nil
+}
+
+// Version 2 and later indexes start with a magic number and a version. Version
+// 1 indexes start right away with the fan-out table; their first entry can't
+// be this large, so there's no ambiguity.
+const indexMagic = "\xFF\x74\x4F\x63"
+
+func (p *pack) readIndex() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.index != nil {
+		return nil
+	}
+	index, closeIndex, err := mapFile(p.fs, p.idxPath)
 	if err != nil {
-		panic("error mapping")
-		return
+		return err
 	}
-	if string([]byte(p.index[:8])) != indexHeader {
-		panic("bad index header")
+	if err := p.parseIndex(index); err != nil {
+		closeIndex()
+		return err
 	}
+	p.index, p.closeIndex = index, closeIndex
+	return nil
 }
 
-const packHeader = "PACK\x00\x00\x00\x02"
+// parseIndex checks the layout of index and fills in the version, fan-out
+// location and object count.
+func (p *pack) parseIndex(index []byte) error {
+	bad := fmt.Errorf("%w: %s", ErrBadPackHeader, p.idxPath)
+	// fan-out table and trailing checksums at the very least
+	if len(index) < 1024+40 {
+		return bad
+	}
+	var minLen uint64
+	if string(index[:4]) == indexMagic {
+		if len(index) < 8+1024+40 || order.Uint32(index[4:]) != 2 {
+			return bad
+		}
+		p.version, p.fanout = 2, 8
+		p.count = order.Uint32(index[8+1020:])
+		// ids, CRCs and offsets; the 64-bit offset table comes after
+		minLen = 8 + 1024 + 28*uint64(p.count) + 40
+	} else {
+		p.version, p.fanout = 1, 0
+		p.count = order.Uint32(index[1020:])
+		// an offset and an id for every object
+		minLen = 1024 + 24*uint64(p.count) + 40
+	}
+	if uint64(len(index)) < minLen {
+		return fmt.Errorf("%w: %s is truncated", ErrBadPackHeader, p.idxPath)
+	}
+	// the fan-out table must never decrease
+	prev := uint32(0)
+	for i := uint32(0); i < 256; i++ {
+		n := order.Uint32(index[p.fanout+4*i:])
+		if n < prev {
+			return bad
+		}
+		prev = n
+	}
+	return nil
+}
 
-func (p *pack) readData() {
-	if p.dataFile != nil {
-		return
+// idAt returns the nth object id in the index.
+func (p *pack) idAt(n uint32) []byte {
+	if p.version == 1 {
+		loc := 1024 + 24*uint64(n) + 4
+		return p.index[loc : loc+20]
 	}
-	var err error
-	p.dataFile, err = os.Open(p.dataPath)
-	if err != nil {
-		return
+	loc := 8 + 1024 + 20*uint64(n)
+	return p.index[loc : loc+20]
+}
+
+// crcAt returns the CRC-32 of the nth object's packed data. Version 1
+// indexes don't store CRCs, so ok is false for them.
+func (p *pack) crcAt(n uint32) (crc uint32, ok bool) {
+	if p.version == 1 {
+		return 0, false
+	}
+	return order.Uint32(p.index[8+1024+20*uint64(p.count)+4*uint64(n):]), true
+}
+
+// offsetAt returns the offset in the pack of the nth object in the index.
+func (p *pack) offsetAt(n uint32) (uint64, error) {
+	if p.version == 1 {
+		return uint64(order.Uint32(p.index[1024+24*uint64(n):])), nil
+	}
+	offsetBase := 8 + 1024 + 24*uint64(p.count)
+	offset := order.Uint32(p.index[offsetBase+4*uint64(n):])
+	if offset&0x80000000 == 0 {
+		return uint64(offset), nil
 	}
-	p.data, err = mmap.Map(p.dataFile, mmap.RDONLY, 0)
+	// The rest of the offset is an index into the table of 64-bit offsets.
+	loc := offsetBase + 4*uint64(p.count) + 8*uint64(offset&0x7FFFFFFF)
+	if loc+8 > uint64(len(p.index))-40 {
+		return 0, fmt.Errorf("%w: %s has a bad 64-bit offset", ErrBadPackHeader, p.idxPath)
+	}
+	return order.Uint64(p.index[loc:]), nil
+}
+
+const packHeader = "PACK\x00\x00\x00\x02"
+
+func (p *pack) readData() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.data != nil {
+		return nil
+	}
+	data, closeData, err := mapFile(p.fs, p.dataPath)
 	if err != nil {
-		return
+		return err
 	}
-	if string([]byte(p.data[:8])) != packHeader {
-		panic("bad packfile header")
+	if len(data) < 12+20 || string(data[:8]) != packHeader {
+		closeData()
+		return fmt.Errorf("%w: %s", ErrBadPackHeader, p.dataPath)
 	}
+	p.data, p.closeData = data, closeData
+	return nil
 }
 
 const (
@@ -78,136 +202,281 @@ const (
 	_OBJ_REF_DELTA
 )
 
-func (p *pack) getObject(id Id) Object {
-	offset := p.offset(id)
-	return p.readObject(offset)
-}
-
-func (p *pack) offset(id Id) uint32 {
+// find returns the position of id in the index, or ErrObjectNotFound if
+// the pack doesn't contain it.
+func (p *pack) find(id Id) (uint32, error) {
+	if len(id) != 20 {
+		return 0, ErrObjectNotFound
+	}
+	if err := p.readIndex(); err != nil {
+		return 0, err
+	}
 	idBytes := []byte(string(id))
-	p.readIndex()
-	// 255 uint32s
-	fan := p.index[8:1032]
-	size := order.Uint32(fan[1020:])
-	// TODO: Make sure fan[id[0]] > fan[id[0] - 1]
-	//       Otherwise our object's definitely not here
-	cnt := order.Uint32(fan[4*id[0]:])
-	// TODO: split up this line so it's easier to read
-	loc := 8 + 1024 + cnt*20
-	suspect := p.index[loc : loc+20]
-	cmp := bytes.Compare(idBytes, suspect)
-	// TODO: allow for failure
-	for lo, hi := uint32(0), size; cmp != 0; cmp = bytes.Compare(idBytes, suspect) {
-		if cmp < 0 {
-			hi = cnt
+	// Objects whose ids start with id[0] are in [lo, hi).
+	lo, hi := uint32(0), order.Uint32(p.index[p.fanout+4*uint32(id[0]):])
+	if id[0] > 0 {
+		lo = order.Uint32(p.index[p.fanout+4*(uint32(id[0])-1):])
+	}
+	for lo < hi {
+		n := lo + (hi-lo)/2
+		cmp := bytes.Compare(idBytes, p.idAt(n))
+		if cmp == 0 {
+			return n, nil
+		} else if cmp < 0 {
+			hi = n
 		} else {
-			lo = cnt + 1
-		}
-		if lo >= hi {
-			return 0
+			lo = n + 1
 		}
-		cnt = (lo + hi) / 2
-		loc = 8 + 1024 + cnt*20
-		suspect = p.index[loc : loc+20]
 	}
+	return 0, ErrObjectNotFound
+}
 
-	// TODO: check for 64-bit offset
-	// calculate which sha1 we looked at
-	n := (loc - 1032) / 20
-	offsetBase := 1032 + 20*size + 4*size
-	offset := order.Uint32(p.index[offsetBase+4*n:])
-	return offset
+// matchPrefix calls fn with each id in the index whose hex form starts
+// with prefix, which has at least two lowercase digits.
+func (p *pack) matchPrefix(prefix string, fn func(Id)) error {
+	if err := p.readIndex(); err != nil {
+		return err
+	}
+	low, err := hex.DecodeString((prefix + strings.Repeat("0", 40))[:40])
+	if err != nil {
+		return err
+	}
+	lo, hi := uint32(0), order.Uint32(p.index[p.fanout+4*uint32(low[0]):])
+	if low[0] > 0 {
+		lo = order.Uint32(p.index[p.fanout+4*(uint32(low[0])-1):])
+	}
+	// the first id that isn't less than the prefix padded with zeros
+	n := lo + uint32(sort.Search(int(hi-lo), func(i int) bool {
+		return bytes.Compare(p.idAt(lo+uint32(i)), low) >= 0
+	}))
+	for ; n < hi && strings.HasPrefix(hex.EncodeToString(p.idAt(n)), prefix); n++ {
+		fn(Id(string(p.idAt(n))))
+	}
+	return nil
+}
+
+// offset returns the offset of id within the pack data, or ErrObjectNotFound
+// if the pack doesn't contain it.
+func (p *pack) offset(id Id) (uint64, error) {
+	n, err := p.find(id)
+	if err != nil {
+		return 0, err
+	}
+	return p.offsetAt(n)
 }
 
-func (p *pack) readObject(offset uint32) Object {
-	objType, obj := p.readRaw(offset)
-
-	switch objType {
-	case _OBJ_COMMIT:
-		println("It's a commit")
-		return parseCommit(obj)
-	case _OBJ_TREE:
-		println("It's a tree")
-		return parseTree(obj)
-	case _OBJ_BLOB:
-		println("It's a blob")
-		return &Blob{obj}
-	case _OBJ_TAG:
-		println("It's a tag")
-	default:
-		println("It's something else")
-		panic("we don't know about this type yet")
+func (p *pack) readObject(offset uint64) (Object, error) {
+	objType, obj, err := p.readRaw(offset, 0)
+	if err != nil {
+		return nil, err
 	}
+	return parseContent(objType, obj)
+}
 
-	return nil
+// maxDeltaDepth bounds how far we'll follow a delta chain, so a corrupt pack
+// with a cycle of REF_DELTA entries can't loop forever or overflow the
+// stack.
+const maxDeltaDepth = 10000
+
+// A packEntry describes the header of an object in a pack.
+type packEntry struct {
+	objType int
+	size    uint64 // inflated size of the entry's data
+	data    uint64 // offset of the compressed data
+	base    uint64 // offset of the delta base, for delta entries
 }
 
-func (p *pack) readRaw(offset uint32) (int, []byte) {
-	p.readData()
+func (p *pack) readEntry(offset uint64) (packEntry, error) {
+	var e packEntry
+	if err := p.readData(); err != nil {
+		return e, err
+	}
+	// the last 20 bytes are the pack checksum
+	end := uint64(len(p.data) - 20)
+	if offset < 12 || offset >= end {
+		return e, corrupt("offset %d out of range in %s", offset, p.dataPath)
+	}
 	objHeader := p.data[offset]
-	objType := int(objHeader & 0x71 >> 4)
+	e.objType = int(objHeader & 0x71 >> 4)
 
 	// size when uncompressed
-	// TODO: should be uint64?
-	objSize := uint32(objHeader & 0x0F)
-	i := uint32(0)
-	shift := uint32(4)
+	e.size = uint64(objHeader & 0x0F)
+	i := uint64(0)
+	shift := uint64(4)
 	for objHeader&0x80 != 0 {
 		i++
+		if offset+i >= end || shift > 60 {
+			return e, corrupt("bad object header at offset %d", offset)
+		}
 		objHeader = p.data[offset+i]
-		objSize |= uint32(objHeader&0x7F) << shift
+		e.size |= uint64(objHeader&0x7F) << shift
 		shift += 7
 	}
 
-	var rawBase []byte
-	if objType == _OBJ_OFS_DELTA {
+	if e.objType == _OBJ_OFS_DELTA {
 		i++
+		if offset+i >= end {
+			return e, corrupt("truncated delta at offset %d", offset)
+		}
 		b := p.data[offset+i]
-		baseOffset := uint32(b & 0x7F)
+		baseOffset := uint64(b & 0x7F)
 		for b&0x80 != 0 {
 			i++
+			if offset+i >= end || baseOffset >= 1<<56 {
+				return e, corrupt("truncated delta at offset %d", offset)
+			}
 			b = p.data[offset+i]
-			baseOffset = ((baseOffset + 1) << 7) | uint32(b&0x7F)
+			baseOffset = ((baseOffset + 1) << 7) | uint64(b&0x7F)
 		}
-		if baseOffset > uint32(len(p.data)) || baseOffset > offset {
-			panic("bad offset")
+		if baseOffset == 0 || baseOffset > offset {
+			return e, corrupt("bad delta base offset at offset %d", offset)
+		}
+		e.base = offset - baseOffset
+	} else if e.objType == _OBJ_REF_DELTA {
+		if offset+i+21 > end {
+			return e, corrupt("truncated delta at offset %d", offset)
 		}
-		objType, rawBase = p.readRaw(offset - baseOffset)
-	} else if objType == _OBJ_REF_DELTA {
 		baseId := Id(string([]byte(p.data[offset+i+1 : offset+i+21])))
 		i += 20
-		baseOffset := p.offset(baseId)
-		objType, rawBase = p.readRaw(baseOffset)
+		baseOffset, err := p.offset(baseId)
+		if err == ErrObjectNotFound {
+			return e, corrupt("delta base %s not in pack", baseId)
+		} else if err != nil {
+			return e, err
+		}
+		e.base = baseOffset
 	}
+	e.data = offset + i + 1
+	return e, nil
+}
 
-	obj := make([]byte, objSize)
-	buf := bytes.NewBuffer(p.data[offset+i+1:])
-	r, err := zlib.NewReader(buf)
+// inflate returns a reader for the compressed data of e.
+func (p *pack) inflate(e packEntry) (io.ReadCloser, error) {
+	z, err := zlib.NewReader(bytes.NewReader(p.data[e.data : len(p.data)-20]))
 	if err != nil {
-		panic(err.Error())
+		return nil, corrupt("offset %d: %v", e.data, err)
+	}
+	return z, nil
+}
+
+// stat returns the type and size of the object at offset without inflating
+// it. For deltas, the size comes from the start of the delta data and the
+// type from the end of the delta chain.
+func (p *pack) stat(offset uint64) (ObjectType, int64, error) {
+	e, err := p.readEntry(offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	size := int64(e.size)
+	if e.objType == _OBJ_OFS_DELTA || e.objType == _OBJ_REF_DELTA {
+		z, err := p.inflate(e)
+		if err != nil {
+			return 0, 0, err
+		}
+		delta := bufio.NewReaderSize(z, 16)
+		_, err = binary.ReadUvarint(delta)
+		if err == nil {
+			var resultLength uint64
+			resultLength, err = binary.ReadUvarint(delta)
+			size = int64(resultLength)
+		}
+		z.Close()
+		if err != nil {
+			return 0, 0, corrupt("truncated delta at offset %d", offset)
+		}
+		for depth := 0; e.objType == _OBJ_OFS_DELTA || e.objType == _OBJ_REF_DELTA; depth++ {
+			if depth > maxDeltaDepth {
+				return 0, 0, corrupt("delta chain too long at offset %d", offset)
+			}
+			if e, err = p.readEntry(e.base); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	return ObjectType(e.objType), size, nil
+}
+
+// readRaw returns the type and content of the object at offset, which is
+// depth deltas into a chain.
+func (p *pack) readRaw(offset uint64, depth int) (int, []byte, error) {
+	if depth > maxDeltaDepth {
+		return 0, nil, corrupt("delta chain too long at offset %d", offset)
+	}
+	e, err := p.readEntry(offset)
+	if err != nil {
+		return 0, nil, err
+	}
+	objType := e.objType
+
+	var rawBase []byte
+	if objType == _OBJ_OFS_DELTA || objType == _OBJ_REF_DELTA {
+		objType, rawBase, err = p.readBase(e.base, depth+1)
+		if err != nil {
+			return 0, nil, err
+		}
 	}
-	r.Read(obj)
+
+	// zlib can't compress by more than about 1032:1
+	if e.size > 1032*uint64(len(p.data)) {
+		return 0, nil, corrupt("implausible object size at offset %d", offset)
+	}
+	obj := make([]byte, e.size)
+	r, err := p.inflate(e)
+	if err != nil {
+		return 0, nil, err
+	}
+	_, err = io.ReadFull(r, obj)
 	r.Close()
+	if err != nil {
+		return 0, nil, corrupt("offset %d: %v", offset, err)
+	}
 
 	if rawBase != nil {
 		// apply delta to base
-		obj = applyDelta(rawBase, obj)
+		obj, err = applyDelta(rawBase, obj)
+		if err != nil {
+			return 0, nil, err
+		}
 	}
 
-	return objType, obj
+	return objType, obj, nil
 }
 
-func applyDelta(base, patch []byte) []byte {
-	// base length; TODO: use for bounds checking
+// readBase is like readRaw, but reads a delta base, which is cached in
+// case other deltas use it too. The result mustn't be modified.
+func (p *pack) readBase(offset uint64, depth int) (int, []byte, error) {
+	if p.bases == nil {
+		return p.readRaw(offset, depth)
+	}
+	key := deltaBaseKey{p, offset}
+	if b, ok := p.bases.get(key); ok {
+		base := b.(deltaBase)
+		return base.objType, base.data, nil
+	}
+	objType, data, err := p.readRaw(offset, depth)
+	if err != nil {
+		return 0, nil, err
+	}
+	p.bases.add(key, deltaBase{objType, data}, int64(len(data)))
+	return objType, data, nil
+}
+
+func applyDelta(base, patch []byte) ([]byte, error) {
 	baseLength, n := decodeVarint(patch)
-	if baseLength != uint64(len(base)) {
-		// TODO: return error
-		panic("base mismatch")
-		return nil
+	if n == 0 || baseLength != uint64(len(base)) {
+		return nil, corrupt("delta base length mismatch")
 	}
 	patch = patch[n:]
 	resultLength, n := decodeVarint(patch)
+	if n == 0 {
+		return nil, corrupt("truncated delta")
+	}
 	patch = patch[n:]
+	// no instruction makes more than 1<<22 bytes of result per byte of
+	// delta, so anything bigger is corrupt, and too big to allocate
+	if resultLength > uint64(len(patch))<<22 {
+		return nil, corrupt("implausible delta result length %d", resultLength)
+	}
 	result := make([]byte, resultLength)
 	loc := uint(0)
 	for len(patch) > 0 {
@@ -215,11 +484,13 @@ func applyDelta(base, patch []byte) []byte {
 		op := patch[0]
 		if op == 0 {
 			// reserved
-			// TODO: better error, don't panic
-			panic("delta opcode 0")
+			return nil, corrupt("delta opcode 0")
 		} else if op&0x80 == 0 {
 			// insert
 			n := uint(op)
+			if i+n > uint(len(patch)) || n > uint(len(result[loc:])) {
+				return nil, corrupt("delta insert out of range")
+			}
 			copy(result[loc:], patch[i:i+n])
 			loc += n
 			patch = patch[i+n:]
@@ -228,6 +499,9 @@ func applyDelta(base, patch []byte) []byte {
 		copyOffset := uint(0)
 		for j := uint(0); j < 4; j++ {
 			if op&(1<<j) != 0 {
+				if i >= uint(len(patch)) {
+					return nil, corrupt("truncated delta")
+				}
 				x := patch[i]
 				i++
 				copyOffset |= uint(x) << (j * 8)
@@ -236,6 +510,9 @@ func applyDelta(base, patch []byte) []byte {
 		copyLength := uint(0)
 		for j := uint(0); j < 3; j++ {
 			if op&(1<<(4+j)) != 0 {
+				if i >= uint(len(patch)) {
+					return nil, corrupt("truncated delta")
+				}
 				x := patch[i]
 				i++
 				copyLength |= uint(x) << (j * 8)
@@ -245,18 +522,23 @@ func applyDelta(base, patch []byte) []byte {
 			copyLength = 1 << 16
 		}
 		if copyOffset+copyLength > uint(len(base)) || copyLength > uint(len(result[loc:])) {
-			panic("oops, that's not good")
+			return nil, corrupt("delta copy out of range")
 		}
 		copy(result[loc:], base[copyOffset:copyOffset+copyLength])
 		loc += copyLength
 		patch = patch[i:]
 	}
-	return result
+	if loc != uint(len(result)) {
+		return nil, corrupt("delta result length mismatch")
+	}
+	return result, nil
 }
 
+// decodeVarint decodes a little-endian base-128 integer from buf. It returns
+// n == 0 if buf ends before the integer does.
 func decodeVarint(buf []byte) (x uint64, n int) {
 	shift := uint64(0)
-	for {
+	for n < len(buf) && shift < 64 {
 		b := buf[n]
 		n++
 		x |= uint64(b&0x7F) << shift
@@ -265,16 +547,53 @@ func decodeVarint(buf []byte) (x uint64, n int) {
 			return
 		}
 	}
-	return
+	return 0, 0
+}
+
+// encodeVarint is the inverse of decodeVarint.
+func encodeVarint(x uint64) []byte {
+	var b []byte
+	for x >= 0x80 {
+		b = append(b, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(b, byte(x))
+}
+
+// idAtOffset returns the id of the object that starts at offset.
+func (p *pack) idAtOffset(offset uint64) (Id, error) {
+	if err := p.readIndex(); err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.byOffset == nil {
+		byOffset := make(map[uint64]uint32, p.count)
+		for n := uint32(0); n < p.count; n++ {
+			o, err := p.offsetAt(n)
+			if err != nil {
+				return "", err
+			}
+			byOffset[o] = n
+		}
+		p.byOffset = byOffset
+	}
+	n, ok := p.byOffset[offset]
+	if !ok {
+		return "", corrupt("no object at offset %d in %s", offset, p.idxPath)
+	}
+	return Id(string(p.idAt(n))), nil
 }
 
 func (p *pack) Close() {
-	if p.indexFile != nil {
-		p.index.Unmap()
-		p.indexFile.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.index != nil {
+		p.closeIndex()
+		p.index = nil
 	}
-	if p.dataFile != nil {
-		p.data.Unmap()
-		p.dataFile.Close()
+	if p.data != nil {
+		p.closeData()
+		p.data = nil
 	}
 }
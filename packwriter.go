@@ -0,0 +1,455 @@
+package git
+
+// This file implements writing packfiles and their indexes.
+// Useful resources:
+//	http://www.kernel.org/pub/software/scm/git/docs/technical/pack-format.txt
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// A PackWriter collects objects and writes them out as a pack. The zero
+// value is ready to use, and writes a pack without deltas.
+type PackWriter struct {
+	// Window is how many of the preceding objects are tried as delta bases
+	// for each object. Zero disables delta compression.
+	Window int
+	// Depth is the longest chain of deltas that will be written.
+	Depth int
+	// ReuseDeltas lets objects that are already stored as deltas in a
+	// repository's packs keep those deltas, if their bases are also being
+	// written.
+	ReuseDeltas bool
+
+	entries []*packWriterEntry
+	ids     map[Id]*packWriterEntry
+}
+
+type packWriterEntry struct {
+	id       Id
+	obj      Object // nil if the object should be read from repo
+	repo     *Repo
+	objType  int
+	size     int64
+	nameHash uint32
+
+	// set when the object is written as a delta
+	base  *packWriterEntry
+	delta []byte
+	depth int
+
+	offset  uint64
+	written bool
+}
+
+// raw returns the contents of e's object.
+func (e *packWriterEntry) raw() ([]byte, error) {
+	if e.obj != nil {
+		return e.obj.Raw(), nil
+	}
+	obj, err := e.repo.GetObject(e.id)
+	if err != nil {
+		return nil, err
+	}
+	return obj.Raw(), nil
+}
+
+// NewPackWriter returns a PackWriter with git's default window and depth.
+func NewPackWriter() *PackWriter {
+	return &PackWriter{Window: 10, Depth: 50, ReuseDeltas: true}
+}
+
+func (pw *PackWriter) add(e *packWriterEntry) {
+	if pw.ids == nil {
+		pw.ids = map[Id]*packWriterEntry{}
+	}
+	pw.ids[e.id] = e
+	pw.entries = append(pw.entries, e)
+}
+
+// Add adds obj to the pack. Objects that have already been added are ignored.
+func (pw *PackWriter) Add(obj Object) {
+	id := ObjectId(obj)
+	if pw.ids[id] != nil {
+		return
+	}
+	content := obj.Raw()
+	pw.add(&packWriterEntry{id: id, obj: obj, objType: objectTypeCode(obj.Header()), size: int64(len(content))})
+}
+
+// AddId adds the object with the given id in r to the pack. The object isn't
+// read until the pack is written.
+func (pw *PackWriter) AddId(r *Repo, id Id) error {
+	return pw.AddIdPath(r, id, "")
+}
+
+// AddIdPath is like AddId, but also gives the path the object was found at.
+// Objects with similar paths are tried as delta bases for each other first.
+func (pw *PackWriter) AddIdPath(r *Repo, id Id, path string) error {
+	if pw.ids[id] != nil {
+		return nil
+	}
+	objType, size, err := r.Stat(id)
+	if err != nil {
+		return err
+	}
+	pw.add(&packWriterEntry{id: id, repo: r, objType: int(objType), size: size, nameHash: nameHash(path)})
+	return nil
+}
+
+// nameHash is the hash git uses to group objects by path. It mostly depends
+// on the last few characters, so files with the same extension sort together.
+func nameHash(path string) uint32 {
+	h := uint32(0)
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f' {
+			continue
+		}
+		h = (h >> 2) + uint32(c)<<24
+	}
+	return h
+}
+
+// Len returns the number of objects that will be written.
+func (pw *PackWriter) Len() int { return len(pw.entries) }
+
+// Write writes the pack to pack and a version 2 index for it to index. It
+// returns the pack's checksum, which git uses to name the files.
+func (pw *PackWriter) Write(pack, index io.Writer) (Id, error) {
+	for _, e := range pw.entries {
+		e.base, e.delta, e.depth, e.written = nil, nil, 0, false
+	}
+	if pw.ReuseDeltas {
+		if err := pw.reuseDeltas(); err != nil {
+			return "", err
+		}
+	}
+	if pw.Window > 0 && pw.Depth > 0 {
+		if err := pw.searchDeltas(); err != nil {
+			return "", err
+		}
+	}
+
+	hw := &hashWriter{w: pack, h: sha1.New()}
+	var header [12]byte
+	copy(header[:], packHeader)
+	order.PutUint32(header[8:], uint32(len(pw.entries)))
+	if _, err := hw.Write(header[:]); err != nil {
+		return "", err
+	}
+
+	idx := make([]indexEntry, 0, len(pw.entries))
+	for _, e := range pw.entries {
+		var err error
+		if idx, err = pw.writeEntry(hw, e, idx); err != nil {
+			return "", err
+		}
+	}
+
+	sum := hw.h.Sum(nil)
+	if _, err := pack.Write(sum); err != nil {
+		return "", err
+	}
+	if err := writeIndex(index, idx, sum); err != nil {
+		return "", err
+	}
+	return Id(string(sum)), nil
+}
+
+// writeEntry writes e to the pack, after its delta base if it has one.
+func (pw *PackWriter) writeEntry(hw *hashWriter, e *packWriterEntry, idx []indexEntry) ([]indexEntry, error) {
+	if e.written {
+		return idx, nil
+	}
+	var err error
+	if e.base != nil {
+		if idx, err = pw.writeEntry(hw, e.base, idx); err != nil {
+			return nil, err
+		}
+	}
+	e.offset = hw.n
+	crc := crc32.NewIEEE()
+	w := io.MultiWriter(hw, crc)
+	if e.base != nil {
+		if _, err := w.Write(packEntryHeader(_OBJ_OFS_DELTA, uint64(len(e.delta)))); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(encodeOffset(e.offset - e.base.offset)); err != nil {
+			return nil, err
+		}
+		err = writeCompressed(w, e.delta)
+	} else {
+		var raw []byte
+		if raw, err = e.raw(); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(packEntryHeader(e.objType, uint64(len(raw)))); err != nil {
+			return nil, err
+		}
+		err = writeCompressed(w, raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	e.written = true
+	// the delta isn't needed anymore
+	e.delta = nil
+	return append(idx, indexEntry{e.id, e.offset, crc.Sum32()}), nil
+}
+
+// reuseDeltas finds objects that are stored in a pack as deltas against
+// other objects in pw, and keeps those deltas rather than searching for new
+// ones.
+func (pw *PackWriter) reuseDeltas() error {
+	for _, e := range pw.entries {
+		if e.repo == nil {
+			continue
+		}
+		// only packs have deltas to reuse
+		s, ok := e.repo.objects.(*FileStore)
+		if !ok {
+			continue
+		}
+		p, offset, err := s.findPacked(e.id)
+		if err == ErrObjectNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		pe, err := p.readEntry(offset)
+		if err != nil {
+			return err
+		}
+		if pe.objType != _OBJ_OFS_DELTA && pe.objType != _OBJ_REF_DELTA {
+			continue
+		}
+		baseId, err := p.idAtOffset(pe.base)
+		if err != nil {
+			return err
+		}
+		base := pw.ids[baseId]
+		if base == nil || pw.reaches(base, e) {
+			continue
+		}
+		z, err := p.inflate(pe)
+		if err != nil {
+			return err
+		}
+		delta := make([]byte, pe.size)
+		_, err = io.ReadFull(z, delta)
+		z.Close()
+		if err != nil {
+			return corrupt("offset %d: %v", offset, err)
+		}
+		e.base, e.delta = base, delta
+	}
+	pw.limitDepth()
+	return nil
+}
+
+// limitDepth breaks delta chains that are longer than pw.Depth and updates
+// the depth of each entry. Cutting one chain short only makes others
+// shorter, so one pass is enough.
+func (pw *PackWriter) limitDepth() {
+	for _, e := range pw.entries {
+		depth := 0
+		for b := e; b.base != nil; b = b.base {
+			depth++
+		}
+		if depth > pw.Depth {
+			e.base, e.delta = nil, nil
+		}
+	}
+	for _, e := range pw.entries {
+		e.depth = 0
+		for b := e; b.base != nil; b = b.base {
+			e.depth++
+		}
+	}
+}
+
+// reaches reports whether following the delta bases from e leads to target.
+func (pw *PackWriter) reaches(e, target *packWriterEntry) bool {
+	for ; e != nil; e = e.base {
+		if e == target {
+			return true
+		}
+	}
+	return false
+}
+
+// deltaOrder sorts delta candidates the way git does: by type, then by path
+// hash, then largest first, since deleting is cheaper to express than adding.
+type deltaOrder []*packWriterEntry
+
+func (o deltaOrder) Len() int      { return len(o) }
+func (o deltaOrder) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o deltaOrder) Less(i, j int) bool {
+	a, b := o[i], o[j]
+	if a.objType != b.objType {
+		return a.objType < b.objType
+	}
+	if a.nameHash != b.nameHash {
+		return a.nameHash < b.nameHash
+	}
+	return a.size > b.size
+}
+
+// searchDeltas tries each object without a delta against the previous
+// Window objects in delta order, and keeps the smallest delta that's worth
+// using.
+func (pw *PackWriter) searchDeltas() error {
+	var candidates []*packWriterEntry
+	for _, e := range pw.entries {
+		if e.base == nil {
+			candidates = append(candidates, e)
+		}
+	}
+	sort.Stable(deltaOrder(candidates))
+
+	type windowEntry struct {
+		e   *packWriterEntry
+		raw []byte
+	}
+	var window []windowEntry
+	for _, e := range candidates {
+		raw, err := e.raw()
+		if err != nil {
+			return err
+		}
+		// A delta has to save a reasonable amount to be worth it.
+		maxSize := len(raw)/2 - 20
+		for _, w := range window {
+			if maxSize <= 0 {
+				break
+			}
+			if w.e.objType != e.objType || w.e.depth >= pw.Depth || w.e.size < e.size/32 || pw.reaches(w.e, e) {
+				continue
+			}
+			if delta := createDelta(w.raw, raw, maxSize); delta != nil {
+				e.base, e.delta, e.depth = w.e, delta, w.e.depth+1
+				maxSize = len(delta) - 1
+			}
+		}
+		window = append(window, windowEntry{e, raw})
+		if len(window) > pw.Window {
+			window = window[1:]
+		}
+	}
+	// Bases of reused deltas may have just become deltas themselves.
+	pw.limitDepth()
+	return nil
+}
+
+// hashWriter writes to w while keeping a running hash and count of what's
+// been written.
+type hashWriter struct {
+	w io.Writer
+	h hash.Hash
+	n uint64
+}
+
+func (hw *hashWriter) Write(b []byte) (int, error) {
+	n, err := hw.w.Write(b)
+	hw.h.Write(b[:n])
+	hw.n += uint64(n)
+	return n, err
+}
+
+func writeCompressed(w io.Writer, data []byte) error {
+	z := zlib.NewWriter(w)
+	if _, err := z.Write(data); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// packEntryHeader encodes an entry's type and inflated size.
+func packEntryHeader(objType int, size uint64) []byte {
+	b := []byte{byte(objType<<4) | byte(size&0x0F)}
+	size >>= 4
+	for size != 0 {
+		b[len(b)-1] |= 0x80
+		b = append(b, byte(size&0x7F))
+		size >>= 7
+	}
+	return b
+}
+
+// encodeOffset encodes the distance back to an OFS_DELTA base. It's the
+// inverse of the decoding in readEntry.
+func encodeOffset(offset uint64) []byte {
+	b := []byte{byte(offset & 0x7F)}
+	for offset >>= 7; offset != 0; offset >>= 7 {
+		offset--
+		b = append([]byte{0x80 | byte(offset&0x7F)}, b...)
+	}
+	return b
+}
+
+// An indexEntry is what a pack index records about each object.
+type indexEntry struct {
+	id     Id
+	offset uint64
+	crc    uint32
+}
+
+type indexOrder []indexEntry
+
+func (o indexOrder) Len() int           { return len(o) }
+func (o indexOrder) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+func (o indexOrder) Less(i, j int) bool { return o[i].id < o[j].id }
+
+// writeIndex writes a version 2 index for a pack with the given entries and
+// checksum. entries is sorted in place.
+func writeIndex(w io.Writer, entries []indexEntry, packSum []byte) error {
+	sort.Sort(indexOrder(entries))
+	b := bytes.NewBuffer(nil)
+	b.WriteString(indexMagic)
+	b.Write([]byte{0, 0, 0, 2})
+
+	var fan [256]uint32
+	for _, e := range entries {
+		fan[e.id[0]]++
+	}
+	var word [8]byte
+	total := uint32(0)
+	for _, n := range fan {
+		total += n
+		order.PutUint32(word[:], total)
+		b.Write(word[:4])
+	}
+	for _, e := range entries {
+		b.WriteString(string(e.id))
+	}
+	for _, e := range entries {
+		order.PutUint32(word[:], e.crc)
+		b.Write(word[:4])
+	}
+	var large []uint64
+	for _, e := range entries {
+		offset := uint32(e.offset)
+		if e.offset >= 0x80000000 {
+			offset = 0x80000000 | uint32(len(large))
+			large = append(large, e.offset)
+		}
+		order.PutUint32(word[:], offset)
+		b.Write(word[:4])
+	}
+	for _, offset := range large {
+		order.PutUint64(word[:], offset)
+		b.Write(word[:])
+	}
+	b.Write(packSum)
+	sum := sha1.Sum(b.Bytes())
+	b.Write(sum[:])
+	_, err := b.WriteTo(w)
+	return err
+}
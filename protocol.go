@@ -11,11 +11,12 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"os"
 	"strconv"
+	"strings"
 )
 
-const zeroId Id = "0000000000000000000000000000000000000000"
+// zeroId is the all-zero id that stands for no object.
+const zeroId Id = "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
 
 // write refs in the format of git receive-pack --stateless-rpc --advertise-refs
 // format of ref is: SHA-1 " " name "\x00" capability { " " capability }
@@ -31,8 +32,11 @@ const zeroId Id = "0000000000000000000000000000000000000000"
 // - shallow - client can fetch shallow clones
 // - no-progress - 
 // - include-tag - 
-func (r *Repo) advertiseRefs(w io.Writer) {
-	refs := r.Refs()
+func (r *Repo) advertiseRefs(w io.Writer) error {
+	refs, err := r.Refs()
+	if err != nil {
+		return err
+	}
 	if len(refs) == 0 {
 		packet := []byte(zeroId.String() + " capabilities^{}\x00\n")
 		writePacket(w, packet)
@@ -57,41 +61,50 @@ func (r *Repo) advertiseRefs(w io.Writer) {
 		}
 	}
 	flush(w)
+	return nil
 }
 
 // readRefs reads advertised refs from the client's perspective.
-func readRefs(r *bufio.Reader) map[string]Id {
+func readRefs(r *bufio.Reader) (map[string]Id, error) {
 	refs := map[string]Id{}
 	gotCaps := false
 	for {
-		packet, _ := readPacket(r)
+		packet, err := readPacket(r)
+		if err != nil {
+			return nil, err
+		}
 		if packet == nil {
 			break
 		}
+		packet = bytes.TrimRight(packet, "\n")
 		if len(packet) < 42 {
-			// error
+			return nil, fmt.Errorf("git: short ref advertisement %q", packet)
 		}
 		id := IdFromBytes(packet[:40])
 		end := len(packet)
 		if !gotCaps {
-			end = bytes.IndexByte(packet, 0)
-			if end < 0 {
-				// error
+			if nul := bytes.IndexByte(packet, 0); nul >= 0 {
+				end = nul
 			}
 			// TODO: read capabilities
 			gotCaps = true
 		}
+		if end < 41 {
+			return nil, fmt.Errorf("git: bad ref advertisement %q", packet)
+		}
 		name := string(packet[41:end])
 		refs[name] = id
 	}
-	return refs
+	return refs, nil
 }
 
-func writeWants(w io.Writer, wants, haves []Id) {
+// writeWants sends the client's side of packfile negotiation. caps are sent
+// with the first want.
+func writeWants(w io.Writer, wants, haves []Id, caps []string) {
 	for i, want := range wants {
 		payload := []byte("want " + want.String())
-		if i == 0 {
-			payload = append(payload, 0)
+		if i == 0 && len(caps) > 0 {
+			payload = append(payload, " "+strings.Join(caps, " ")...)
 		}
 		payload = append(payload, '\n')
 		writePacket(w, payload)
@@ -109,24 +122,27 @@ func writeWants(w io.Writer, wants, haves []Id) {
 // negotiate initiates packfile negotiation from the server's perspective.
 // The server expects some "want" lines and "have" lines from r and writes
 // out the necessary packfiles to w.
-func (repo *Repo) negotiate(w io.Writer, r io.Reader) {
+func (repo *Repo) negotiate(w io.Writer, r io.Reader) error {
 	//capFlags := 0
 	haveCaps := false
 
 	var wants []Id
 	for {
-		packet, _ := readPacket(r)
+		packet, err := readPacket(r)
+		if err != nil {
+			return err
+		}
 		if packet == nil {
 			break
 		}
 		if len(packet) < 45 || !bytes.HasPrefix(packet, []byte("want ")) {
-			// error
+			return fmt.Errorf("git: expected want, got %q", packet)
 		}
 		id := IdFromBytes(packet[5:45])
 		wants = append(wants, id)
 		if !haveCaps {
 			haveCaps = true
-			if len(packet) < 45 || packet[45] != ' ' {
+			if len(packet) < 46 || packet[45] != ' ' {
 				// error
 			}
 			//caps := bytes.Split(packet[46:], []byte{' '}, -1)
@@ -135,29 +151,35 @@ func (repo *Repo) negotiate(w io.Writer, r io.Reader) {
 
 	var haves []Id
 	for {
-		packet, _ := readPacket(r)
+		packet, err := readPacket(r)
+		if err != nil {
+			return err
+		}
 		if packet == nil {
 			break
 		}
 		if len(packet) < 45 || !bytes.HasPrefix(packet, []byte("have ")) {
-			// error
+			return fmt.Errorf("git: expected have, got %q", packet)
 		}
 		haves = append(haves, IdFromBytes(packet[5:45]))
 	}
 
 	// hack alert
 	nak(w)
-	f, err := os.Open(repo.file("objects/pack/pack-2f9aa945c499706d76fa3807faac9e8f01e48dd7.pack"))
+	f, err := repo.fsFor("objects").Open(repo.file("objects/pack/pack-2f9aa945c499706d76fa3807faac9e8f01e48dd7.pack"))
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
-	io.Copy(w, f)
-	f.Close()
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
 }
 
+// readPacket reads a pkt-line. It returns nil for a flush packet, and the
+// server's message as an error for an "ERR" packet.
 func readPacket(r io.Reader) (b []byte, err error) {
 	n := make([]byte, 4)
-	_, err = r.Read(n)
+	_, err = io.ReadFull(r, n)
 	if err != nil {
 		return
 	}
@@ -167,15 +189,20 @@ func readPacket(r io.Reader) (b []byte, err error) {
 	}
 	// flush
 	if n2 == 0 {
-		println(string(b))
+		return
+	}
+	if n2 < 4 {
+		err = fmt.Errorf("git: bad packet length %q", n)
 		return
 	}
 	b = make([]byte, n2-4)
-	_, err = r.Read(b)
+	_, err = io.ReadFull(r, b)
 	if err != nil {
-		b = nil
+		return nil, err
+	}
+	if msg, ok := bytes.CutPrefix(b, []byte("ERR ")); ok {
+		return nil, fmt.Errorf("git: remote error: %s", bytes.TrimRight(msg, "\n"))
 	}
-	println(string(b))
 	return
 }
 
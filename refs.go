@@ -2,78 +2,257 @@ package git
 
 import (
 	"bytes"
-	"io/ioutil"
-	"os"
-	"path/filepath"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func (r *Repo) resolveRef(name string) (id Id) {
-	if id := r.refs[name]; id != "" {
-		return id
+// fsFor returns the file system that holds the named file in the
+// repository. A linked worktree has its own HEAD and a few private refs,
+// and shares everything else with the main repository.
+func (r *Repo) fsFor(name string) FileSystem {
+	if r.common == nil {
+		return r.fs
 	}
-	content, err := ioutil.ReadFile(r.file(name))
-	if err != nil {
-		panic(err.Error())
-		return ""
+	name = r.file(name)
+	ref := strings.TrimPrefix(name, "logs/")
+	for _, private := range []string{"refs/bisect/", "refs/worktree/", "refs/rewritten/"} {
+		if strings.HasPrefix(ref, private) {
+			return r.fs
+		}
+	}
+	top := name
+	if slash := strings.IndexByte(name, '/'); slash >= 0 {
+		top = name[:slash]
+	}
+	switch top {
+	case "logs":
+		if name == "logs/HEAD" {
+			return r.fs
+		}
+		return r.common
+	case "refs", "objects", "info", "hooks", "config", "packed-refs", "shallow", "remotes", "branches", "worktrees":
+		return r.common
+	}
+	return r.fs
+}
+
+// maxSymrefDepth is how many symbolic refs are followed before giving up,
+// as in git, so a cycle of them is an error rather than endless recursion.
+const maxSymrefDepth = 5
+
+// resolveRef returns the id the named ref points to, following symbolic
+// refs. Refs are read afresh every time, so changes made by other programs
+// are seen. The error wraps fs.ErrNotExist if there's no such ref.
+func (r *Repo) resolveRef(name string) (Id, error) {
+	return r.resolveRefDepth(name, 0)
+}
+
+// resolveRefDepth is like resolveRef, but name was reached by following
+// depth symbolic refs.
+func (r *Repo) resolveRefDepth(name string, depth int) (Id, error) {
+	fsys, file := r.fsFor(name), r.file(name)
+	content, err := fs.ReadFile(fsys, file)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		// a directory, like refs/remotes/origin, isn't a ref either
+		if info, serr := fs.Stat(fsys, file); serr == nil && info.IsDir() {
+			err = &fs.PathError{Op: "read", Path: file, Err: fs.ErrNotExist}
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		// refs that haven't changed since git pack-refs are only packed
+		packed, perr := r.packedRefs()
+		if perr != nil {
+			return "", perr
+		}
+		if id := packed[name]; id != "" {
+			return id, nil
+		}
+		return "", err
+	} else if err != nil {
+		return "", err
 	}
 	content = bytes.TrimSpace(content)
-	if bytes.HasPrefix(content, []byte("ref: ")) {
-		// TODO: probably shouldn't cache symrefs -- at least not this way
-		id = r.resolveRef(string(content[5:]))
-	} else {
-		id = IdFromString(string(content))
+	if target, ok := bytes.CutPrefix(content, []byte("ref: ")); ok {
+		if depth >= maxSymrefDepth {
+			return "", fmt.Errorf("git: %s: too many levels of symbolic refs", name)
+		}
+		id, err := r.resolveRefDepth(string(target), depth+1)
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("git: %s points to %s: %w", name, target, fs.ErrNotExist)
+		}
+		return id, err
 	}
-	if id != "" {
-		r.refs[name] = id
+	id := IdFromString(string(content))
+	if id == "" {
+		return "", fmt.Errorf("git: bad ref %s: %q", name, content)
+	}
+	return id, nil
+}
+
+// ref returns the id the named ref points to, whether it's a loose ref or
+// in packed-refs. ok is false if there's no such ref.
+func (r *Repo) ref(name string) (id Id, ok bool, err error) {
+	id, err = r.resolveRef(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
 	}
-	return
+	return id, true, nil
+}
+
+// symref returns the ref that the symbolic ref name points to, or "" if
+// name isn't a symbolic ref.
+func (r *Repo) symref(name string) (string, error) {
+	content, err := fs.ReadFile(r.fsFor(name), r.file(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	content = bytes.TrimSpace(content)
+	if !bytes.HasPrefix(content, []byte("ref: ")) {
+		return "", nil
+	}
+	return string(content[5:]), nil
 }
 
 // Head returns the Id of the HEAD ref.
-func (r *Repo) Head() Id {
+func (r *Repo) Head() (Id, error) {
 	return r.resolveRef("HEAD")
 }
 
-func (r *Repo) packedRefs() {
-	if r.refs == nil {
-		r.refs = map[string]Id{}
-	}
-	packedRefs := r.file("packed-refs")
-	content, err := ioutil.ReadFile(packedRefs)
-	if err != nil {
-		return
+// packedRefs returns the refs in the packed-refs file.
+func (r *Repo) packedRefs() (map[string]Id, error) {
+	refs := map[string]Id{}
+	content, err := fs.ReadFile(r.fsFor("packed-refs"), "packed-refs")
+	if errors.Is(err, fs.ErrNotExist) {
+		return refs, nil
+	} else if err != nil {
+		return nil, err
 	}
 	lines := bytes.Split(content, []byte{'\n'})
 	for _, line := range lines {
-		if len(line) == 0 || line[0] == '#' {
+		if len(line) == 0 || line[0] == '#' || line[0] == '^' {
 			continue
 		}
 		parts := bytes.SplitN(line, []byte{' '}, 2)
-		if len(parts[0]) != 40 {
+		if len(parts) != 2 || len(parts[0]) != 40 {
 			continue
 		}
-		id := IdFromString(string(parts[0]))
-		refname := string(parts[1])
-		r.refs[refname] = id
+		if id := IdFromString(string(parts[0])); id != "" {
+			refs[string(parts[1])] = id
+		}
 	}
-	return
+	return refs, nil
+}
+
+// Refs returns a map of ref names to Ids. As in git, refs that can't be
+// resolved, such as a symbolic ref to a branch that's gone, are left out.
+func (r *Repo) Refs() (map[string]Id, error) {
+	refs, _, err := r.listRefs()
+	return refs, err
 }
 
-// Refs returns a map of ref names to Ids.
-func (r *Repo) Refs() map[string]Id {
-	r.packedRefs()
-	if head := r.Head(); head != "" {
-		r.refs["HEAD"] = head
+// listRefs is like Refs, but also returns why each broken ref couldn't be
+// resolved. Dangling symbolic refs, which git puts up with, and an unborn
+// HEAD aren't counted as broken.
+func (r *Repo) listRefs() (refs map[string]Id, broken map[string]error, err error) {
+	// loose refs override packed ones
+	if refs, err = r.packedRefs(); err != nil {
+		return nil, nil, err
+	}
+	broken = map[string]error{}
+	check := func(name string) {
+		id, err := r.resolveRef(name)
+		if err != nil {
+			delete(refs, name)
+			if !errors.Is(err, fs.ErrNotExist) {
+				broken[name] = err
+			}
+			return
+		}
+		refs[name] = id
+	}
+	check("HEAD")
+	if err := fs.WalkDir(r.fsFor("refs"), "refs", refVisitor(check)); err != nil {
+		return nil, nil, err
 	}
-	filepath.Walk(r.file("refs"), refVisitor(r))
-	return r.refs
+	return refs, broken, nil
 }
 
-func refVisitor(r *Repo) filepath.WalkFunc {
-	return func(path string, f os.FileInfo, err error) error {
-		if !f.IsDir() {
-			r.resolveRef(path[5:])
+// refVisitor calls check on each ref file. A broken ref mustn't hide the
+// others, so check doesn't return an error.
+func refVisitor(check func(name string)) fs.WalkDirFunc {
+	return func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			check(name)
 		}
 		return nil
 	}
 }
+
+// A reflogEntry is one line of a ref's log: the ref moved from old to new.
+type reflogEntry struct {
+	old, new Id
+	who      string // the identity and time of the change
+	msg      string
+}
+
+// time returns when the change was made, from the end of e.who.
+func (e reflogEntry) time() (time.Time, bool) {
+	fields := strings.Fields(e.who)
+	if len(fields) < 2 {
+		return time.Time{}, false
+	}
+	secs, err := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(secs, 0), true
+}
+
+// readReflog returns the entries in the log of the named ref, oldest first.
+// A ref without a log has no entries.
+func (r *Repo) readReflog(name string) ([]reflogEntry, error) {
+	logName := path.Join("logs", name)
+	content, err := fs.ReadFile(r.fsFor(logName), logName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseReflog(name, content)
+}
+
+func parseReflog(name string, content []byte) ([]reflogEntry, error) {
+	var entries []reflogEntry
+	for _, line := range bytes.Split(content, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		if len(line) < 82 || line[40] != ' ' || line[81] != ' ' {
+			return nil, fmt.Errorf("git: bad reflog line for %s: %q", name, line)
+		}
+		e := reflogEntry{old: IdFromString(string(line[:40])), new: IdFromString(string(line[41:81]))}
+		if e.old == "" || e.new == "" {
+			return nil, fmt.Errorf("git: bad reflog line for %s: %q", name, line)
+		}
+		rest := string(line[82:])
+		if tab := strings.IndexByte(rest, '\t'); tab >= 0 {
+			e.who, e.msg = rest[:tab], rest[tab+1:]
+		} else {
+			e.who = rest
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
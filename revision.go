@@ -0,0 +1,523 @@
+package git
+
+// This file implements git's revision syntax, as described in
+// gitrevisions(7).
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResolveRevision returns the id of the object that expr names in git's
+// revision syntax, as git rev-parse does. It understands:
+//
+//   - full and abbreviated object ids, such as 5740508
+//   - ref names, looked for in the same order as git: the name itself if
+//     it's HEAD, a pseudo-ref like FETCH_HEAD or a full ref name, and then
+//     refs/<name>, refs/tags/<name>, refs/heads/<name>, refs/remotes/<name>
+//     and refs/remotes/<name>/HEAD; @ on its own means HEAD
+//   - ref@{n}, the ref's value n changes ago, and ref@{date}, its value at
+//     a date such as 2024-01-31, "2024-01-31 12:00:00" or 2.weeks.ago,
+//     from its reflog; without a ref, the current branch's reflog is used
+//   - @{-n}, the nth branch checked out before the current one
+//   - branch@{upstream} or branch@{u}, the branch that branch tracks, or
+//     the current branch's if branch is left out
+//   - rev^n, rev's nth parent; rev^ is rev^1 and rev^0 is rev itself
+//   - rev~n, rev's nth ancestor, following first parents
+//   - rev^{type}, rev peeled until it's a commit, tree, blob or tag;
+//     rev^{object}, rev if it exists; and rev^{}, rev peeled until it isn't
+//     a tag
+//   - rev:path, the object at path in rev's tree
+//
+// It returns an error wrapping ErrUnknownRevision if some part of expr
+// doesn't match anything, and an *AmbiguousIdError if an abbreviated id
+// matches several objects.
+func (r *Repo) ResolveRevision(expr string) (Id, error) {
+	rev, file, hasPath := splitRevisionPath(expr)
+	if hasPath && rev == "" {
+		return "", fmt.Errorf("git: revision %q: the index isn't supported", expr)
+	}
+	end := revisionSuffix(rev)
+	id, err := r.resolveBase(rev[:end])
+	if err != nil {
+		return "", err
+	}
+	if id, err = r.applySuffixes(id, rev[:end], rev[end:]); err != nil {
+		return "", err
+	}
+	if hasPath {
+		return r.treePath(id, rev, file)
+	}
+	return id, nil
+}
+
+// splitRevisionPath splits expr at the colon before a path, if it has one.
+// Colons in @{...}, as in a reflog date, don't count.
+func splitRevisionPath(expr string) (rev, path string, ok bool) {
+	depth := 0
+	for i := 0; i < len(expr); i++ {
+		switch expr[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ':':
+			if depth == 0 {
+				return expr[:i], expr[i+1:], true
+			}
+		}
+	}
+	return expr, "", false
+}
+
+// revisionSuffix returns where the ^ and ~ operators in rev start.
+func revisionSuffix(rev string) int {
+	for i := 0; i < len(rev); i++ {
+		switch rev[i] {
+		case '@':
+			if strings.HasPrefix(rev[i:], "@{") {
+				if end := strings.IndexByte(rev[i:], '}'); end >= 0 {
+					i += end
+				}
+			}
+		case '^', '~':
+			return i
+		}
+	}
+	return len(rev)
+}
+
+// resolveBase resolves the part of a revision before any operators: a name
+// or an id, possibly followed by @{...}.
+func (r *Repo) resolveBase(base string) (Id, error) {
+	if base == "@" {
+		base = "HEAD"
+	}
+	at := strings.Index(base, "@{")
+	if at < 0 {
+		return r.resolveName(base)
+	}
+	if !strings.HasSuffix(base, "}") {
+		return "", fmt.Errorf("git: bad revision %q", base)
+	}
+	name, spec := base[:at], base[at+2:len(base)-1]
+	if strings.HasPrefix(spec, "-") {
+		n, err := strconv.Atoi(spec[1:])
+		if err != nil || n < 1 || name != "" {
+			return "", fmt.Errorf("git: bad revision %q", base)
+		}
+		return r.previousBranch(n)
+	}
+	switch strings.ToLower(spec) {
+	case "upstream", "u":
+		return r.upstream(name)
+	}
+	return r.reflogAt(name, spec)
+}
+
+// resolveName resolves an object id, a ref name or an abbreviated id, in
+// that order.
+func (r *Repo) resolveName(name string) (Id, error) {
+	if name == "" {
+		return "", fmt.Errorf("git: empty revision")
+	}
+	if id := IdFromString(name); id != "" {
+		if !r.Has(id) {
+			return "", fmt.Errorf("%w: %s", ErrUnknownRevision, name)
+		}
+		return id, nil
+	}
+	if full, id, err := r.dwimRef(name); err != nil || full != "" {
+		return id, err
+	}
+	if len(name) >= minAbbrev && strings.Trim(strings.ToLower(name), "0123456789abcdef") == "" {
+		id, err := r.ResolvePrefix(name)
+		if err == nil || !errors.Is(err, ErrObjectNotFound) {
+			return id, err
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnknownRevision, name)
+}
+
+// refRules are the places a short ref name is looked for, in order.
+var refRules = []string{
+	"%s",
+	"refs/%s",
+	"refs/tags/%s",
+	"refs/heads/%s",
+	"refs/remotes/%s",
+	"refs/remotes/%s/HEAD",
+}
+
+// dwimRef returns the full name of the ref that name means, and its id. full
+// is "" if name doesn't match any ref.
+func (r *Repo) dwimRef(name string) (full string, id Id, err error) {
+	for i, rule := range refRules {
+		full := fmt.Sprintf(rule, name)
+		if i == 0 && isPseudoRef(name) {
+			// HEAD and the like live at the top of the repository
+		} else if !strings.HasPrefix(full, "refs/") || !validRefName(full) {
+			continue
+		}
+		id, ok, err := r.ref(full)
+		if err != nil {
+			return "", "", err
+		} else if ok {
+			return full, id, nil
+		}
+	}
+	return "", "", nil
+}
+
+// isPseudoRef reports whether name looks like HEAD, FETCH_HEAD, ORIG_HEAD
+// and the other refs git keeps outside refs/.
+func isPseudoRef(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if (c < 'A' || c > 'Z') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// currentBranch returns the full name of the branch HEAD points to, or ""
+// if HEAD is detached.
+func (r *Repo) currentBranch() (string, error) {
+	branch, err := r.symref("HEAD")
+	if err != nil || !strings.HasPrefix(branch, "refs/heads/") {
+		return "", err
+	}
+	return branch, nil
+}
+
+// reflogAt returns the value of the named ref at the point in its reflog
+// that spec, a count or a date, picks out.
+func (r *Repo) reflogAt(name, spec string) (Id, error) {
+	full := name
+	if name == "" {
+		// the current branch, or HEAD itself if it's detached
+		branch, err := r.currentBranch()
+		if err != nil {
+			return "", err
+		}
+		full = branch
+		if full == "" {
+			full = "HEAD"
+		}
+	} else {
+		var err error
+		if full, _, err = r.dwimRef(name); err != nil {
+			return "", err
+		} else if full == "" {
+			return "", fmt.Errorf("%w: %s", ErrUnknownRevision, name)
+		}
+	}
+	entries, err := r.readReflog(full)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "", fmt.Errorf("%w: %s has no reflog", ErrUnknownRevision, full)
+	}
+	oldest := entries[0]
+	if n, err := strconv.Atoi(spec); err == nil && n >= 0 {
+		switch k := len(entries); {
+		case n < k:
+			return entries[k-1-n].new, nil
+		case n == k && oldest.old != zeroId:
+			return oldest.old, nil
+		default:
+			return "", fmt.Errorf("%w: the log for %s only has %d entries", ErrUnknownRevision, full, k)
+		}
+	}
+	when, ok := parseReflogDate(spec, time.Now())
+	if !ok {
+		return "", fmt.Errorf("git: bad reflog selector @{%s}", spec)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if t, ok := entries[i].time(); ok && !t.After(when) {
+			return entries[i].new, nil
+		}
+	}
+	// the log doesn't go back that far, so use its start, as git does
+	if oldest.old != zeroId {
+		return oldest.old, nil
+	}
+	return oldest.new, nil
+}
+
+var reflogDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseReflogDate parses the dates git accepts in @{...}: absolute dates
+// and times in local time, and relative ones like 2.weeks.ago.
+func parseReflogDate(s string, now time.Time) (time.Time, bool) {
+	for _, layout := range reflogDateLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, true
+		}
+	}
+	switch s {
+	case "now":
+		return now, true
+	case "yesterday":
+		return now.AddDate(0, 0, -1), true
+	}
+	fields := strings.FieldsFunc(s, func(c rune) bool { return c == '.' || c == ' ' })
+	if len(fields) != 3 || fields[2] != "ago" {
+		return time.Time{}, false
+	}
+	n, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return time.Time{}, false
+	}
+	switch strings.TrimSuffix(fields[1], "s") {
+	case "second":
+		return now.Add(-time.Duration(n) * time.Second), true
+	case "minute":
+		return now.Add(-time.Duration(n) * time.Minute), true
+	case "hour":
+		return now.Add(-time.Duration(n) * time.Hour), true
+	case "day":
+		return now.AddDate(0, 0, -n), true
+	case "week":
+		return now.AddDate(0, 0, -7*n), true
+	case "month":
+		return now.AddDate(0, -n, 0), true
+	case "year":
+		return now.AddDate(-n, 0, 0), true
+	}
+	return time.Time{}, false
+}
+
+// previousBranch returns the nth branch checked out before the current
+// one, from the checkouts recorded in HEAD's reflog.
+func (r *Repo) previousBranch(n int) (Id, error) {
+	entries, err := r.readReflog("HEAD")
+	if err != nil {
+		return "", err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		msg := entries[i].msg
+		if !strings.HasPrefix(msg, "checkout: moving from ") {
+			continue
+		}
+		if n--; n > 0 {
+			continue
+		}
+		from := strings.TrimPrefix(msg, "checkout: moving from ")
+		if to := strings.LastIndex(from, " to "); to >= 0 {
+			from = from[:to]
+		}
+		if id, ok, err := r.ref("refs/heads/" + from); err != nil || ok {
+			return id, err
+		}
+		// HEAD was detached, so from is a revision
+		return r.resolveName(from)
+	}
+	return "", fmt.Errorf("%w: not enough branches have been checked out", ErrUnknownRevision)
+}
+
+// upstream returns the id of the branch that the named branch, or the
+// current branch, tracks, according to its branch.<name>.remote and
+// branch.<name>.merge settings.
+func (r *Repo) upstream(name string) (Id, error) {
+	var branch string
+	var err error
+	if name == "" || name == "HEAD" {
+		if branch, err = r.currentBranch(); err != nil {
+			return "", err
+		} else if branch == "" {
+			return "", fmt.Errorf("%w: HEAD isn't on a branch", ErrUnknownRevision)
+		}
+	} else if branch, _, err = r.dwimRef(name); err != nil {
+		return "", err
+	} else if !strings.HasPrefix(branch, "refs/heads/") {
+		return "", fmt.Errorf("%w: %s isn't a branch", ErrUnknownRevision, name)
+	}
+	short := strings.TrimPrefix(branch, "refs/heads/")
+	c, err := readConfig(r.fsFor("config"), "config")
+	if err != nil {
+		return "", err
+	}
+	remote, _ := c.get("branch." + short + ".remote")
+	merge, _ := c.get("branch." + short + ".merge")
+	if remote == "" || merge == "" {
+		return "", fmt.Errorf("%w: no upstream configured for branch %s", ErrUnknownRevision, short)
+	}
+	tracking := merge
+	if remote != "." {
+		// the remote's fetch refspecs say where it keeps merge locally
+		tracking = ""
+		for _, spec := range c["remote."+remote+".fetch"] {
+			if dst, ok := mapRefspec(spec, merge); ok {
+				tracking = dst
+				break
+			}
+		}
+		if tracking == "" {
+			return "", fmt.Errorf("%w: %s isn't fetched from %s", ErrUnknownRevision, merge, remote)
+		}
+	}
+	id, ok, err := r.ref(tracking)
+	if err != nil {
+		return "", err
+	} else if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownRevision, tracking)
+	}
+	return id, nil
+}
+
+// mapRefspec returns the name that the fetch refspec spec gives the remote
+// ref name, if spec matches it.
+func mapRefspec(spec, name string) (string, bool) {
+	src, dst, ok := strings.Cut(strings.TrimPrefix(spec, "+"), ":")
+	if !ok {
+		return "", false
+	}
+	star := strings.IndexByte(src, '*')
+	if star < 0 {
+		return dst, src == name
+	}
+	prefix, suffix := src[:star], src[star+1:]
+	if len(name) < len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	return strings.Replace(dst, "*", name[len(prefix):len(name)-len(suffix)], 1), true
+}
+
+// applySuffixes applies the ^ and ~ operators in ops to id, which rev
+// names.
+func (r *Repo) applySuffixes(id Id, rev, ops string) (Id, error) {
+	for ops != "" {
+		op := ops[0]
+		ops = ops[1:]
+		var err error
+		if op == '^' && strings.HasPrefix(ops, "{") {
+			end := strings.IndexByte(ops, '}')
+			if end < 0 {
+				return "", fmt.Errorf("git: bad revision %q", rev+string(op)+ops)
+			}
+			if id, err = r.peelTo(id, ops[1:end]); err != nil {
+				return "", err
+			}
+			ops = ops[end+1:]
+			continue
+		}
+		// a count, which is 1 if it's left out
+		digits := len(ops) - len(strings.TrimLeft(ops, "0123456789"))
+		n := 1
+		if digits > 0 {
+			if n, err = strconv.Atoi(ops[:digits]); err != nil {
+				return "", fmt.Errorf("git: bad revision %q", rev+string(op)+ops)
+			}
+		}
+		ops = ops[digits:]
+		switch op {
+		case '^':
+			id, err = r.parent(id, n)
+		case '~':
+			for i := 0; i < n && err == nil; i++ {
+				id, err = r.parent(id, 1)
+			}
+		default:
+			err = fmt.Errorf("git: bad revision %q", rev+string(op)+ops)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return id, nil
+}
+
+// peelTo follows tags, and commits to their trees, until it reaches an
+// object of type objType, as for rev^{objType}. An empty objType peels
+// tags only, and "object" peels nothing.
+func (r *Repo) peelTo(id Id, objType string) (Id, error) {
+	switch objType {
+	case "", "object", "commit", "tree", "blob", "tag":
+	default:
+		return "", fmt.Errorf("git: revision operator ^{%s} isn't supported", objType)
+	}
+	for {
+		obj, err := r.GetObject(id)
+		if err != nil {
+			return "", err
+		}
+		if objType == "object" || obj.Header() == objType {
+			return id, nil
+		}
+		switch obj := obj.(type) {
+		case *Tag:
+			id = obj.Target()
+			continue
+		case *Commit:
+			if objType == "tree" {
+				id = obj.Tree()
+				continue
+			}
+		}
+		if objType == "" {
+			return id, nil
+		}
+		return "", fmt.Errorf("%w: %s is a %s, not a %s", ErrUnknownRevision, id, obj.Header(), objType)
+	}
+}
+
+// parent returns the nth parent of the commit id, or the commit itself if
+// n is 0.
+func (r *Repo) parent(id Id, n int) (Id, error) {
+	id, err := r.peelTo(id, "commit")
+	if err != nil || n == 0 {
+		return id, err
+	}
+	obj, err := r.GetObject(id)
+	if err != nil {
+		return "", err
+	}
+	parents := obj.(*Commit).Parents()
+	if n > len(parents) {
+		return "", fmt.Errorf("%w: commit %s has no parent %d", ErrUnknownRevision, id, n)
+	}
+	return parents[n-1], nil
+}
+
+// treePath returns the id of the object at path in the tree of id, which
+// rev names.
+func (r *Repo) treePath(id Id, rev, path string) (Id, error) {
+	id, err := r.peelTo(id, "tree")
+	if err != nil {
+		return "", err
+	}
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		obj, err := r.GetObject(id)
+		if err != nil {
+			return "", err
+		}
+		tree, ok := obj.(*Tree)
+		if !ok {
+			return "", fmt.Errorf("%w: %s isn't a directory in %s", ErrUnknownRevision, path, rev)
+		}
+		entry, ok := tree.Lookup(name)
+		if !ok {
+			return "", fmt.Errorf("%w: %s isn't in %s", ErrUnknownRevision, path, rev)
+		}
+		id = entry.Id
+	}
+	return id, nil
+}
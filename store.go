@@ -0,0 +1,625 @@
+package git
+
+// This file implements storing objects in an objects directory, as loose
+// objects and packs.
+
+import (
+	"bufio"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An ObjectStore holds a repository's objects. Its methods may be called
+// from several goroutines at once.
+type ObjectStore interface {
+	// Get returns the object with the given id, or an error wrapping
+	// ErrObjectNotFound.
+	Get(id Id) (Object, error)
+	// Stat returns the type and size of the object with the given id.
+	Stat(id Id) (ObjectType, int64, error)
+	// Has reports whether the store holds the object with the given id.
+	Has(id Id) bool
+	// Put adds obj to the store, if it isn't there already, and returns
+	// its id.
+	Put(obj Object) (Id, error)
+	// Iterate calls fn for every object in the store, stopping at the
+	// first error fn returns. An object that's stored more than once may
+	// be visited more than once.
+	Iterate(fn func(id Id, objType ObjectType) error) error
+}
+
+// A FileStore keeps objects in a directory laid out like .git/objects. New
+// objects are written as loose objects; packs are read but never written,
+// except by IndexPack. Objects are also looked for in the directories
+// listed in info/alternates, but never written there.
+type FileStore struct {
+	fs      FileSystem
+	dir     string
+	mu      sync.Mutex // guards packs, scanned and all
+	packs   []*pack
+	scanned time.Time    // when the pack directory was last read
+	packMod time.Time    // the pack directory's modification time then
+	bases   *lru         // delta bases, shared with the alternates
+	extra   []string     // alternates from the environment rather than info/alternates
+	all     []*FileStore // this store followed by its alternates, once read
+}
+
+// NewFileStore returns a store for the objects directory dir.
+func NewFileStore(dir string) *FileStore {
+	return NewFileStoreFS(NewOSFS(dir), ".")
+}
+
+// NewFileStoreFS returns a store for the objects directory dir in fsys.
+func NewFileStoreFS(fsys FileSystem, dir string) *FileStore {
+	return &FileStore{fs: fsys, dir: dir, bases: newLRU(defaultDeltaCacheSize)}
+}
+
+func (s *FileStore) Get(id Id) (Object, error) {
+	loose, p, offset, err := s.find(id)
+	if err == ErrObjectNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, id)
+	} else if err != nil {
+		return nil, err
+	}
+	if p != nil {
+		return p.readObject(offset)
+	}
+	objType, content, err := loose.readLoose(id)
+	if err != nil {
+		return nil, err
+	}
+	return parseContent(objType, content)
+}
+
+// Stat only reads the object's header, so it's much cheaper than Get.
+func (s *FileStore) Stat(id Id) (ObjectType, int64, error) {
+	loose, p, offset, err := s.find(id)
+	if err == ErrObjectNotFound {
+		return 0, 0, fmt.Errorf("%w: %s", ErrObjectNotFound, id)
+	} else if err != nil {
+		return 0, 0, err
+	}
+	if p != nil {
+		return p.stat(offset)
+	}
+	return loose.statLoose(id)
+}
+
+// find returns where id is stored: either the store, s or one of its
+// alternates, that has it as a loose object, or a pack and an offset.
+func (s *FileStore) find(id Id) (*FileStore, *pack, uint64, error) {
+	if len(id) != 20 {
+		// such as the "" that IdFromString returns for a bad id
+		return nil, nil, 0, ErrObjectNotFound
+	}
+	stores, err := s.stores()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	loose, p, offset, err := findIn(stores, id)
+	if err != ErrObjectNotFound {
+		return loose, p, offset, err
+	}
+	// The object may be in a pack that's appeared since we last looked,
+	// perhaps because a repack just moved it out of a loose file.
+	if changed, err := rescanPacks(stores); err != nil {
+		return nil, nil, 0, err
+	} else if !changed {
+		return nil, nil, 0, ErrObjectNotFound
+	}
+	return findIn(stores, id)
+}
+
+func findIn(stores []*FileStore, id Id) (*FileStore, *pack, uint64, error) {
+	for _, st := range stores {
+		if _, err := fs.Stat(st.fs, st.loosePath(id)); err == nil {
+			return st, nil, 0, nil
+		}
+		p, offset, err := st.findLocalPacked(id)
+		if err != ErrObjectNotFound {
+			return nil, p, offset, err
+		}
+	}
+	return nil, nil, 0, ErrObjectNotFound
+}
+
+func (s *FileStore) statLoose(id Id) (ObjectType, int64, error) {
+	f, err := s.fs.Open(s.loosePath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, 0, ErrObjectNotFound
+	} else if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	z, err := zlib.NewReader(f)
+	if err != nil {
+		return 0, 0, corrupt("loose object %s: %v", id, err)
+	}
+	defer z.Close()
+	// the header is tiny; don't inflate more than we need
+	objType, size, err := readLooseHeader(bufio.NewReaderSize(z, 64))
+	return ObjectType(objType), size, err
+}
+
+func (s *FileStore) Has(id Id) bool {
+	_, _, _, err := s.find(id)
+	return err == nil
+}
+
+// Put writes obj as a loose object. Objects that are already in the store,
+// loose or packed, aren't written again. The object is written to a
+// temporary file and synced before it's renamed into place, so a crash
+// never leaves a partial object behind.
+func (s *FileStore) Put(obj Object) (Id, error) {
+	id := ObjectId(obj)
+	if s.Has(id) {
+		return id, nil
+	}
+	name := s.loosePath(id)
+	dir := path.Dir(name)
+	if err := s.fs.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+	f, err := s.fs.TempFile(dir, "tmp_obj_")
+	if err != nil {
+		return "", err
+	}
+	defer s.fs.Remove(f.Name())
+	z := zlib.NewWriter(f)
+	_, err = z.Write(ObjectFull(obj))
+	if cerr := z.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = s.fs.Chmod(f.Name(), 0444)
+	}
+	if err == nil {
+		err = s.fs.Rename(f.Name(), name)
+	}
+	if err != nil {
+		return "", err
+	}
+	// make the rename itself durable
+	if d, err := s.fs.Open(dir); err == nil {
+		if d, ok := d.(File); ok {
+			d.Sync()
+		}
+		d.Close()
+	}
+	return id, nil
+}
+
+// Iterate visits each store's loose objects first, then the objects in each
+// of its packs in index order, and then moves on to the alternates.
+func (s *FileStore) Iterate(fn func(id Id, objType ObjectType) error) error {
+	stores, err := s.stores()
+	if err != nil {
+		return err
+	}
+	for _, st := range stores {
+		if err := st.iterateLocal(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileStore) iterateLocal(fn func(id Id, objType ObjectType) error) error {
+	loose, err := s.looseIds()
+	if err != nil {
+		return err
+	}
+	for _, id := range loose {
+		objType, _, err := s.statLoose(id)
+		if err == ErrObjectNotFound {
+			// removed since we listed it, probably by a repack
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := fn(id, objType); err != nil {
+			return err
+		}
+	}
+	packs, err := s.findPacks()
+	if err != nil {
+		return err
+	}
+	for _, p := range packs {
+		if err := p.readIndex(); err != nil {
+			return err
+		}
+		for n := uint32(0); n < p.count; n++ {
+			offset, err := p.offsetAt(n)
+			if err != nil {
+				return err
+			}
+			objType, _, err := p.stat(offset)
+			if err != nil {
+				return err
+			}
+			if err := fn(Id(string(p.idAt(n))), objType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *FileStore) loosePath(id Id) string {
+	sha1 := id.String()
+	return path.Join(s.dir, sha1[0:2], sha1[2:])
+}
+
+func (s *FileStore) packDir() string {
+	return path.Join(s.dir, "pack")
+}
+
+// readLoose returns the type code and contents of a loose object.
+func (s *FileStore) readLoose(id Id) (int, []byte, error) {
+	f, err := s.fs.Open(s.loosePath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil, ErrObjectNotFound
+	} else if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	z, err := zlib.NewReader(f)
+	if err != nil {
+		return 0, nil, corrupt("loose object %s: %v", id, err)
+	}
+	defer z.Close()
+	b, err := io.ReadAll(z)
+	if err != nil {
+		return 0, nil, corrupt("loose object %s: %v", id, err)
+	}
+	return splitHeader(b)
+}
+
+// looseIds returns the ids of all loose objects.
+func (s *FileStore) looseIds() ([]Id, error) {
+	dirs, err := fs.ReadDir(s.fs, s.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ids []Id
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 || IdFromString(dir.Name()+strings.Repeat("0", 38)) == "" {
+			continue
+		}
+		files, err := fs.ReadDir(s.fs, path.Join(s.dir, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			// temporary files and the like don't have 38 hex digit names
+			if id := IdFromString(dir.Name() + file.Name()); id != "" && !file.IsDir() {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// matchPrefix returns the ids of the objects in s and its alternates
+// whose hex forms start with prefix, which has at least two lowercase
+// digits, in order.
+func (s *FileStore) matchPrefix(prefix string) ([]Id, error) {
+	stores, err := s.stores()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := matchPrefixIn(stores, prefix)
+	if err != nil || len(ids) > 0 {
+		return ids, err
+	}
+	if changed, err := rescanPacks(stores); err != nil || !changed {
+		return nil, err
+	}
+	return matchPrefixIn(stores, prefix)
+}
+
+func matchPrefixIn(stores []*FileStore, prefix string) ([]Id, error) {
+	seen := map[Id]bool{}
+	for _, st := range stores {
+		// loose objects are named by the rest of their ids
+		files, err := fs.ReadDir(st.fs, path.Join(st.dir, prefix[:2]))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, file := range files {
+			if strings.HasPrefix(file.Name(), prefix[2:]) {
+				if id := IdFromString(prefix[:2] + file.Name()); id != "" && !file.IsDir() {
+					seen[id] = true
+				}
+			}
+		}
+		packs, err := st.findPacks()
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range packs {
+			if err := p.matchPrefix(prefix, func(id Id) { seen[id] = true }); err != nil {
+				return nil, err
+			}
+		}
+	}
+	ids := make([]Id, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// findPacks returns s's packs, looking for them the first time it's called.
+func (s *FileStore) findPacks() ([]*pack, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.scanned.IsZero() {
+		if err := s.scanPacks(); err != nil {
+			return nil, err
+		}
+	}
+	return s.packs, nil
+}
+
+// packRescanInterval is the least time between rescans of a store's pack
+// directory, so a stream of lookups for missing objects doesn't read it
+// over and over.
+const packRescanInterval = time.Second
+
+// rescanPacks rescans the pack directories of stores, reporting whether
+// any of them changed.
+func rescanPacks(stores []*FileStore) (bool, error) {
+	changed := false
+	for _, st := range stores {
+		c, err := st.rescanPacks()
+		if err != nil {
+			return false, err
+		}
+		changed = changed || c
+	}
+	return changed, nil
+}
+
+// rescanPacks looks for packs that have been added or removed since s
+// last looked, unless that was very recently and the pack directory
+// hasn't been modified since. It reports whether anything changed.
+func (s *FileStore) rescanPacks() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.scanned) < packRescanInterval {
+		info, err := fs.Stat(s.fs, s.packDir())
+		if err != nil || info.ModTime().Equal(s.packMod) {
+			return false, nil
+		}
+	}
+	old := s.packs
+	if err := s.scanPacks(); err != nil {
+		return false, err
+	}
+	if len(old) != len(s.packs) {
+		return true, nil
+	}
+	for i, p := range old {
+		if s.packs[i] != p {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// scanPacks reads s's pack directory, keeping the packs that are still
+// there. s.mu must be held.
+func (s *FileStore) scanPacks() error {
+	// check the time first, so changes made while reading aren't missed
+	s.packMod = time.Time{}
+	if info, err := fs.Stat(s.fs, s.packDir()); err == nil {
+		s.packMod = info.ModTime()
+	}
+	files, err := fs.ReadDir(s.fs, s.packDir())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	old := make(map[string]*pack, len(s.packs))
+	for _, p := range s.packs {
+		old[p.idxPath] = p
+	}
+	var packs []*pack
+	for _, f := range files {
+		name := f.Name()
+		if path.Ext(name) != ".idx" {
+			continue
+		}
+		p := old[path.Join(s.packDir(), name)]
+		if p == nil {
+			p = s.newPack(strings.TrimSuffix(name, ".idx"))
+		}
+		delete(old, p.idxPath)
+		packs = append(packs, p)
+	}
+	for _, p := range old {
+		// Other goroutines may still be reading a pack that's gone, so
+		// leave closing it to the garbage collector.
+		runtime.SetFinalizer(p, (*pack).Close)
+	}
+	s.packs = packs
+	s.scanned = time.Now()
+	return nil
+}
+
+// newPack returns the pack named base in s's pack directory.
+func (s *FileStore) newPack(base string) *pack {
+	p := newPack(s.fs, s.packDir(), base)
+	p.bases = s.bases
+	return p
+}
+
+// addPack adds a pack that was just installed in s's pack directory. If s
+// hasn't looked for its packs yet, it will find this one when it does.
+func (s *FileStore) addPack(base string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.scanned.IsZero() {
+		return
+	}
+	p := s.newPack(base)
+	for _, q := range s.packs {
+		if q.idxPath == p.idxPath {
+			return
+		}
+	}
+	s.packs = append(s.packs, p)
+}
+
+// findPacked returns the pack containing id and its offset there. The packs
+// of alternates are searched too.
+func (s *FileStore) findPacked(id Id) (*pack, uint64, error) {
+	stores, err := s.stores()
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, st := range stores {
+		p, offset, err := st.findLocalPacked(id)
+		if err != ErrObjectNotFound {
+			return p, offset, err
+		}
+	}
+	return nil, 0, ErrObjectNotFound
+}
+
+// findLocalPacked is like findPacked, but only searches s's own packs.
+func (s *FileStore) findLocalPacked(id Id) (*pack, uint64, error) {
+	packs, err := s.findPacks()
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, p := range packs {
+		offset, err := p.offset(id)
+		if err != ErrObjectNotFound {
+			return p, offset, err
+		}
+	}
+	return nil, 0, ErrObjectNotFound
+}
+
+// maxAlternateDepth is how deeply alternates can list more alternates. Git
+// has the same limit.
+const maxAlternateDepth = 5
+
+// stores returns s followed by all of its alternates, reading them the first
+// time it's called.
+func (s *FileStore) stores() ([]*FileStore, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.all != nil {
+		return s.all, nil
+	}
+	seen := map[string]bool{s.key(): true}
+	alternates, err := s.readAlternates(seen, 1)
+	if err != nil {
+		return nil, err
+	}
+	for _, alt := range alternates {
+		alt.bases = s.bases
+	}
+	s.all = append([]*FileStore{s}, alternates...)
+	return s.all, nil
+}
+
+// readAlternates returns the stores listed in s's info/alternates, and
+// theirs in turn, skipping any in seen.
+func (s *FileStore) readAlternates(seen map[string]bool, depth int) ([]*FileStore, error) {
+	content, err := fs.ReadFile(s.fs, path.Join(s.dir, "info", "alternates"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	var dirs []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '"' {
+			if line, err = strconv.Unquote(line); err != nil {
+				continue
+			}
+		}
+		dirs = append(dirs, line)
+	}
+	dirs = append(dirs, s.extra...)
+	var stores []*FileStore
+	for _, dir := range dirs {
+		// Like git, skip alternates that don't exist rather than failing.
+		alt := s.alternate(dir)
+		if alt == nil || seen[alt.key()] {
+			continue
+		}
+		if info, err := fs.Stat(alt.fs, alt.dir); err != nil || !info.IsDir() {
+			continue
+		}
+		seen[alt.key()] = true
+		stores = append(stores, alt)
+		if depth < maxAlternateDepth {
+			more, err := alt.readAlternates(seen, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			stores = append(stores, more...)
+		}
+	}
+	return stores, nil
+}
+
+// alternate returns a store for the objects directory dir, which is either
+// absolute or relative to s's directory. It returns nil if dir can't be
+// reached from s's file system.
+func (s *FileStore) alternate(dir string) *FileStore {
+	if o, ok := s.fs.(osFS); ok {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(o.dir, filepath.FromSlash(s.dir), dir)
+		}
+		return NewFileStore(filepath.Clean(dir))
+	}
+	// other file systems can only refer to directories inside themselves
+	name := path.Join(s.dir, dir)
+	if path.IsAbs(dir) || !fs.ValidPath(name) {
+		return nil
+	}
+	return NewFileStoreFS(s.fs, name)
+}
+
+// key identifies s's directory, so the same alternate isn't used twice.
+func (s *FileStore) key() string {
+	if o, ok := s.fs.(osFS); ok {
+		dir := filepath.Join(o.dir, filepath.FromSlash(s.dir))
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = real
+		}
+		return dir
+	}
+	return fmt.Sprintf("%p %s", s.fs, path.Clean(s.dir))
+}
@@ -0,0 +1,368 @@
+package git
+
+// This file implements streaming access to object contents, so large blobs
+// don't have to fit in memory.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// maxMemoryBase is the largest delta base that's kept in memory while a
+// delta is applied. Larger bases are spooled to a temporary file.
+const maxMemoryBase = 32 << 20
+
+// OpenBlob returns a reader for the contents of the blob with the given id,
+// along with its size. The caller must close the reader.
+func (r *Repo) OpenBlob(id Id) (io.ReadCloser, int64, error) {
+	s, ok := r.objects.(*FileStore)
+	if !ok {
+		// other stores hold whole objects anyway
+		obj, err := r.objects.Get(id)
+		if err != nil {
+			return nil, 0, err
+		}
+		blob, ok := obj.(*Blob)
+		if !ok {
+			return nil, 0, fmt.Errorf("git: %s is not a blob", id)
+		}
+		return ioutil.NopCloser(bytes.NewReader(blob.Raw())), int64(len(blob.Raw())), nil
+	}
+	loose, p, offset, err := s.find(id)
+	if err == ErrObjectNotFound {
+		return nil, 0, fmt.Errorf("%w: %s", ErrObjectNotFound, id)
+	} else if err != nil {
+		return nil, 0, err
+	}
+	var rc io.ReadCloser
+	var objType int
+	var size int64
+	if p != nil {
+		rc, objType, size, err = p.open(offset, 0)
+	} else {
+		rc, objType, size, err = loose.openLoose(id)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if objType != _OBJ_BLOB {
+		rc.Close()
+		return nil, 0, fmt.Errorf("git: %s is not a blob", id)
+	}
+	return rc, size, nil
+}
+
+// objectTypeCode returns the pack type code for an object header name.
+func objectTypeCode(name string) int {
+	switch name {
+	case "commit":
+		return _OBJ_COMMIT
+	case "tree":
+		return _OBJ_TREE
+	case "blob":
+		return _OBJ_BLOB
+	case "tag":
+		return _OBJ_TAG
+	}
+	return 0
+}
+
+// readCloser reads from Reader and closes everything in closers when closed.
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (rc *readCloser) Close() error {
+	var err error
+	for _, c := range rc.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// sizedReader reads exactly left bytes from r, and reports a truncated
+// object if r ends early.
+type sizedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (s *sizedReader) Read(b []byte) (int, error) {
+	if s.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > s.left {
+		b = b[:s.left]
+	}
+	n, err := s.r.Read(b)
+	s.left -= int64(n)
+	if err == io.EOF && s.left > 0 {
+		err = corrupt("object is truncated")
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (s *FileStore) openLoose(id Id) (io.ReadCloser, int, int64, error) {
+	f, err := s.fs.Open(s.loosePath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, 0, ErrObjectNotFound
+	} else if err != nil {
+		return nil, 0, 0, err
+	}
+	z, err := zlib.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, 0, 0, corrupt("loose object %s: %v", id, err)
+	}
+	br := bufio.NewReader(z)
+	objType, size, err := readLooseHeader(br)
+	if err != nil {
+		z.Close()
+		f.Close()
+		return nil, 0, 0, err
+	}
+	return &readCloser{&sizedReader{br, size}, []io.Closer{z, f}}, objType, size, nil
+}
+
+// readLooseHeader reads the "type size\x00" header of a loose object.
+func readLooseHeader(r *bufio.Reader) (int, int64, error) {
+	header, err := r.ReadSlice(0)
+	if err != nil {
+		return 0, 0, corrupt("malformed object header")
+	}
+	i := bytes.IndexByte(header, ' ')
+	if i < 0 {
+		return 0, 0, corrupt("malformed object header")
+	}
+	objType := objectTypeCode(string(header[:i]))
+	size, err := strconv.ParseInt(string(header[i+1:len(header)-1]), 10, 64)
+	if objType == 0 || err != nil || size < 0 {
+		return 0, 0, corrupt("malformed object header %q", header)
+	}
+	return objType, size, nil
+}
+
+// open returns a reader for the object at offset, which is depth deltas
+// into a chain. Deltas are applied as the object is read; only the delta
+// base needs to be stored.
+func (p *pack) open(offset uint64, depth int) (io.ReadCloser, int, int64, error) {
+	if depth > maxDeltaDepth {
+		return nil, 0, 0, corrupt("delta chain too long at offset %d", offset)
+	}
+	e, err := p.readEntry(offset)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if e.objType != _OBJ_OFS_DELTA && e.objType != _OBJ_REF_DELTA {
+		z, err := p.inflate(e)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		return &readCloser{&sizedReader{z, int64(e.size)}, []io.Closer{z, packRef{p}}}, e.objType, int64(e.size), nil
+	}
+
+	baseReader, objType, baseSize, err := p.open(e.base, depth+1)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	base, baseCloser, err := spool(baseReader, baseSize)
+	baseReader.Close()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	// inflate the delta only once the base is read, so a long chain
+	// doesn't hold a decompressor open for every link
+	z, err := p.inflate(e)
+	if err != nil {
+		baseCloser.Close()
+		return nil, 0, 0, err
+	}
+	d, size, err := newDeltaReader(base, baseSize, bufio.NewReader(z))
+	if err != nil {
+		z.Close()
+		baseCloser.Close()
+		return nil, 0, 0, err
+	}
+	return &readCloser{d, []io.Closer{z, baseCloser, packRef{p}}}, objType, size, nil
+}
+
+// packRef keeps a pack from being closed by the garbage collector while
+// a reader is still inflating its data.
+type packRef struct {
+	p *pack
+}
+
+func (packRef) Close() error { return nil }
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// tempFile is a temporary file that's removed when it's closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// spool reads size bytes from r into something that can be read at random.
+func spool(r io.Reader, size int64) (io.ReaderAt, io.Closer, error) {
+	if size <= maxMemoryBase {
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, nil, corrupt("delta base: %v", err)
+		}
+		return bytes.NewReader(buf), nopCloser{}, nil
+	}
+	f, err := ioutil.TempFile("", "git-delta-base")
+	if err != nil {
+		return nil, nil, err
+	}
+	t := tempFile{f}
+	n, err := io.Copy(t, r)
+	if err != nil {
+		t.Close()
+		return nil, nil, err
+	}
+	if n != size {
+		t.Close()
+		return nil, nil, corrupt("delta base is %d bytes, expected %d", n, size)
+	}
+	return t, t, nil
+}
+
+// A deltaReader applies a delta to a base as it's read. It does the same
+// thing as applyDelta, but reads the delta a little at a time.
+type deltaReader struct {
+	base     io.ReaderAt
+	baseSize int64
+	delta    *bufio.Reader
+	left     int64 // bytes of the result not yet read
+
+	// the instruction being executed
+	insert  int64 // bytes left to insert from the delta
+	copyPos int64 // position in base to copy from
+	copyLen int64 // bytes left to copy from base
+}
+
+func newDeltaReader(base io.ReaderAt, baseSize int64, delta *bufio.Reader) (*deltaReader, int64, error) {
+	baseLength, err := binary.ReadUvarint(delta)
+	if err != nil || baseLength != uint64(baseSize) {
+		return nil, 0, corrupt("delta base length mismatch")
+	}
+	resultLength, err := binary.ReadUvarint(delta)
+	if err != nil || int64(resultLength) < 0 {
+		return nil, 0, corrupt("truncated delta")
+	}
+	d := &deltaReader{base: base, baseSize: baseSize, delta: delta, left: int64(resultLength)}
+	return d, d.left, nil
+}
+
+func (d *deltaReader) Read(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		if d.insert == 0 && d.copyLen == 0 {
+			if err := d.next(); err == io.EOF {
+				if n > 0 {
+					return n, nil
+				}
+				return 0, io.EOF
+			} else if err != nil {
+				return n, err
+			}
+		}
+		var m int
+		var err error
+		if d.insert > 0 {
+			m, err = d.delta.Read(b[n:min64(int64(len(b)), int64(n)+d.insert)])
+			d.insert -= int64(m)
+		} else {
+			m, err = d.base.ReadAt(b[n:min64(int64(len(b)), int64(n)+d.copyLen)], d.copyPos)
+			d.copyPos += int64(m)
+			d.copyLen -= int64(m)
+			if err == io.EOF && m > 0 {
+				err = nil
+			}
+		}
+		n += m
+		d.left -= int64(m)
+		if err == io.EOF {
+			return n, corrupt("truncated delta")
+		} else if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// next decodes the next delta instruction.
+func (d *deltaReader) next() error {
+	op, err := d.delta.ReadByte()
+	if err == io.EOF {
+		if d.left != 0 {
+			return corrupt("delta result length mismatch")
+		}
+		return io.EOF
+	} else if err != nil {
+		return err
+	}
+	if op == 0 {
+		// reserved
+		return corrupt("delta opcode 0")
+	} else if op&0x80 == 0 {
+		// insert
+		if int64(op) > d.left {
+			return corrupt("delta insert out of range")
+		}
+		d.insert = int64(op)
+		return nil
+	}
+	var copyOffset, copyLength int64
+	for j := uint(0); j < 7; j++ {
+		if op&(1<<j) == 0 {
+			continue
+		}
+		x, err := d.delta.ReadByte()
+		if err != nil {
+			return corrupt("truncated delta")
+		}
+		if j < 4 {
+			copyOffset |= int64(x) << (j * 8)
+		} else {
+			copyLength |= int64(x) << ((j - 4) * 8)
+		}
+	}
+	if copyLength == 0 {
+		copyLength = 1 << 16
+	}
+	if copyOffset+copyLength > d.baseSize || copyLength > d.left {
+		return corrupt("delta copy out of range")
+	}
+	d.copyPos, d.copyLen = copyOffset, copyLength
+	return nil
+}
@@ -0,0 +1,165 @@
+package git
+
+// This file implements checking packs, like git verify-pack.
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A PackReport describes a pack checked by VerifyPack.
+type PackReport struct {
+	Id      Id // the pack's checksum
+	Objects []PackObject
+}
+
+// A PackObject describes one object in a pack. The fields are the ones
+// git verify-pack -v prints.
+type PackObject struct {
+	Id         Id
+	Type       ObjectType
+	Size       int64  // inflated size of the entry; for a delta, the size of the delta
+	PackedSize int64  // size of the entry in the pack, including its header
+	Offset     uint64 // where the entry starts in the pack
+	Depth      int    // length of the delta chain, or 0 if this isn't a delta
+	Base       Id     // the delta base, if this is a delta
+}
+
+// VerifyPack checks the pack at path, which can name either the .pack or
+// the .idx file. It checks both files' checksums, the CRC-32 of each entry,
+// that every object inflates to its size and every delta applies, and that
+// each object's contents match its id. The report covers every object
+// checked before the first problem, which is returned as an error.
+func VerifyPack(path string) (*PackReport, error) {
+	base := strings.TrimSuffix(strings.TrimSuffix(path, ".idx"), ".pack")
+	p := newPack(NewOSFS(filepath.Dir(base)), ".", filepath.Base(base))
+	// objects are checked in pack order, so a delta's base has usually just
+	// been read, and caching bases saves inflating whole chains again
+	p.bases = newLRU(defaultDeltaCacheSize)
+	defer p.Close()
+	if err := p.readIndex(); err != nil {
+		return nil, err
+	}
+	if err := p.readData(); err != nil {
+		return nil, err
+	}
+
+	report := &PackReport{}
+	index, data := []byte(p.index), []byte(p.data)
+	if sum := sha1.Sum(index[:len(index)-20]); !bytes.Equal(sum[:], index[len(index)-20:]) {
+		return report, corrupt("%s: index checksum mismatch", p.idxPath)
+	}
+	packSum := data[len(data)-20:]
+	if sum := sha1.Sum(data[:len(data)-20]); !bytes.Equal(sum[:], packSum) {
+		return report, corrupt("%s: pack checksum mismatch", p.dataPath)
+	}
+	if !bytes.Equal(index[len(index)-40:len(index)-20], packSum) {
+		return report, corrupt("%s: index is for a different pack", p.idxPath)
+	}
+	report.Id = Id(string(packSum))
+	if count := order.Uint32(data[8:]); count != p.count {
+		return report, corrupt("%s: pack has %d objects, index has %d", p.dataPath, count, p.count)
+	}
+
+	// Entries are checked in pack order, which also tells us how big each is.
+	positions := make([]uint32, p.count)
+	offsets := make([]uint64, p.count)
+	for n := uint32(0); n < p.count; n++ {
+		offset, err := p.offsetAt(n)
+		if err != nil {
+			return report, err
+		}
+		positions[n], offsets[n] = n, offset
+	}
+	sort.Sort(offsetOrder{positions, offsets})
+	end := uint64(len(data) - 20)
+	for i, n := range positions {
+		offset := offsets[i]
+		next := end
+		if i+1 < len(offsets) {
+			next = offsets[i+1]
+		}
+		if (i == 0 && offset != 12) || next <= offset || next > end {
+			return report, corrupt("%s: bad offset %d", p.idxPath, offset)
+		}
+		obj, err := p.verifyObject(n, offset, next)
+		if err != nil {
+			return report, err
+		}
+		report.Objects = append(report.Objects, obj)
+	}
+	return report, nil
+}
+
+// offsetOrder sorts index positions by their offsets in the pack.
+type offsetOrder struct {
+	positions []uint32
+	offsets   []uint64
+}
+
+func (b offsetOrder) Len() int           { return len(b.offsets) }
+func (b offsetOrder) Less(i, j int) bool { return b.offsets[i] < b.offsets[j] }
+func (b offsetOrder) Swap(i, j int) {
+	b.positions[i], b.positions[j] = b.positions[j], b.positions[i]
+	b.offsets[i], b.offsets[j] = b.offsets[j], b.offsets[i]
+}
+
+// verifyObject checks the nth object in the index, which occupies
+// [offset, next) in the pack.
+func (p *pack) verifyObject(n uint32, offset, next uint64) (PackObject, error) {
+	id := Id(string(p.idAt(n)))
+	obj := PackObject{Id: id, Offset: offset, PackedSize: int64(next - offset)}
+	if crc, ok := p.crcAt(n); ok && crc != crc32.ChecksumIEEE(p.data[offset:next]) {
+		return obj, corrupt("%s: CRC mismatch", id)
+	}
+	e, err := p.readEntry(offset)
+	if err != nil {
+		return obj, err
+	}
+	obj.Size = int64(e.size)
+
+	// the entry's data has to inflate to exactly its size
+	z, err := p.inflate(e)
+	if err != nil {
+		return obj, err
+	}
+	size, err := io.Copy(ioutil.Discard, z)
+	z.Close()
+	if err != nil || uint64(size) != e.size {
+		return obj, corrupt("%s: doesn't inflate to its size", id)
+	}
+
+	if e.objType == _OBJ_OFS_DELTA || e.objType == _OBJ_REF_DELTA {
+		if obj.Base, err = p.idAtOffset(e.base); err != nil {
+			return obj, err
+		}
+		for d := e; d.objType == _OBJ_OFS_DELTA || d.objType == _OBJ_REF_DELTA; obj.Depth++ {
+			if obj.Depth > maxDeltaDepth {
+				return obj, corrupt("%s: delta chain too long", id)
+			}
+			if d, err = p.readEntry(d.base); err != nil {
+				return obj, err
+			}
+		}
+	}
+
+	objType, content, err := p.readRaw(offset, 0)
+	if err != nil {
+		return obj, err
+	}
+	obj.Type = ObjectType(objType)
+	h := sha1.New()
+	h.Write([]byte(obj.Type.String() + " " + strconv.Itoa(len(content)) + "\x00"))
+	h.Write(content)
+	if Id(string(h.Sum(nil))) != id {
+		return obj, corrupt("%s: contents don't match id", id)
+	}
+	return obj, nil
+}